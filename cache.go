@@ -0,0 +1,126 @@
+package jsonselect
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultSelectorCacheSize is the number of compiled selectors kept by
+// the selector cache unless SetSelectorCacheSize says otherwise.
+const DefaultSelectorCacheSize = 256
+
+// CacheStats describes the activity of the selector cache since it was
+// last reset.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	// Entries is the number of selectors currently cached, out of at most
+	// Size.
+	Entries int `json:"entries"`
+	Size    int `json:"size"`
+}
+
+// selectorCache keeps the most recently used compiled selectors, keyed by
+// their text.  Programs do not depend on the document they are run
+// against, so a single cache is shared by every parser.
+type selectorCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// recent orders the cached programs from most to least recently used.
+	recent *list.List
+	stats  CacheStats
+}
+
+var compiledSelectors = &selectorCache{
+	size:    DefaultSelectorCacheSize,
+	entries: make(map[string]*list.Element),
+	recent:  list.New(),
+}
+
+// SetSelectorCacheSize bounds the number of compiled selectors that
+// GetValues and the other selector methods keep for reuse, evicting the
+// least recently used ones beyond it; a size of 0 disables the cache.
+func SetSelectorCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	c := compiledSelectors
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.evict()
+}
+
+// SelectorCacheStats returns the hit, miss and eviction counts of the
+// selector cache along with its occupancy.
+func SelectorCacheStats() CacheStats {
+	c := compiledSelectors
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.recent.Len()
+	stats.Size = c.size
+	return stats
+}
+
+// ResetSelectorCache empties the selector cache and zeroes its statistics.
+func ResetSelectorCache() {
+	c := compiledSelectors
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.recent.Init()
+	c.stats = CacheStats{}
+}
+
+// compileSelector returns the compiled form of selector, from the cache if
+// possible.  Selectors that fail to compile are not cached.
+func compileSelector(selector string) (*Program, error) {
+	c := compiledSelectors
+	c.mu.Lock()
+	if c.size == 0 {
+		c.mu.Unlock()
+		return Compile(selector)
+	}
+	if element, ok := c.entries[selector]; ok {
+		c.recent.MoveToFront(element)
+		c.stats.Hits++
+		c.mu.Unlock()
+		return element.Value.(*Program), nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	// Compile without holding the lock; if another goroutine compiles the
+	// same selector meanwhile, the first program cached is kept.
+	program, err := Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return program, nil
+	}
+	if element, ok := c.entries[selector]; ok {
+		c.recent.MoveToFront(element)
+		return element.Value.(*Program), nil
+	}
+	c.entries[selector] = c.recent.PushFront(program)
+	c.evict()
+	return program, nil
+}
+
+// evict drops the least recently used programs until the cache fits its
+// size; the caller must hold the lock.
+func (c *selectorCache) evict() {
+	for c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Program).selector)
+		c.stats.Evictions++
+	}
+}
@@ -1,7 +1,13 @@
 package jsonselect
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type exprElement struct {
@@ -22,6 +28,7 @@ var precedenceMap = map[string]int{
 	"$=": 3,
 	"^=": 3,
 	"*=": 3,
+	"~=": 3,
 	"=":  3,
 	"!=": 3,
 	"&&": 4,
@@ -38,7 +45,11 @@ var comparatorMap = map[string]func(lhs exprElement, rhs exprElement) exprElemen
 		return exprElement{value, J_NUMBER}
 	},
 	"%": func(lhs exprElement, rhs exprElement) exprElement {
-		value := float64(getInt32(lhs.value) % getInt32(rhs.value))
+		divisor := getInt32(rhs.value)
+		if divisor == 0 {
+			return exprElement{nil, J_NULL}
+		}
+		value := float64(getInt32(lhs.value) % divisor)
 		return exprElement{value, J_NUMBER}
 	},
 	"+": func(lhs exprElement, rhs exprElement) exprElement {
@@ -114,110 +125,414 @@ var comparatorMap = map[string]func(lhs exprElement, rhs exprElement) exprElemen
 		return exprElement{false, J_BOOLEAN}
 	},
 	"&&": func(lhs exprElement, rhs exprElement) exprElement {
-		if lhs.value.(bool) && rhs.value.(bool) {
+		if exprElementIsTruthy(lhs) && exprElementIsTruthy(rhs) {
 			return exprElement{true, J_BOOLEAN}
 		}
 		return exprElement{false, J_BOOLEAN}
 	},
 	"||": func(lhs exprElement, rhs exprElement) exprElement {
-		if lhs.value.(bool) || rhs.value.(bool) {
+		if exprElementIsTruthy(lhs) || exprElementIsTruthy(rhs) {
 			return exprElement{true, J_BOOLEAN}
 		}
 		return exprElement{false, J_BOOLEAN}
 	},
 }
 
-func (p *Parser) evaluateExpressionWithPrecedence(elements []*exprElement, precedenceLevel int) []*exprElement {
-	var newExpression []*exprElement
-	var i int
-	var element *exprElement
-	for i = 0; i < len(elements); i++ {
-		element = elements[i]
-		if element.typ == J_OPER && precedenceMap[element.value.(string)] == precedenceLevel {
-			lhs := newExpression[len(newExpression)-1]
-			rhs := elements[i+1]
-			newExpression = newExpression[0 : len(newExpression)-1]
-			if exprElementsMatch(*lhs, *rhs) {
-				result := comparatorMap[element.value.(string)](*lhs, *rhs)
-				newExpression = append(newExpression, &result)
-			} else {
-				logger.Print("Cannot compare ", lhs.value, " and ", rhs.value, "; types differ: ", rhs.typ, " != ", lhs.typ)
-				newExpression = append(newExpression, &exprElement{false, J_BOOLEAN})
+// binaryOperations holds the comparatorMap entry of each binary opcode.
+var binaryOperations [opcodeCount]func(lhs exprElement, rhs exprElement) exprElement
+
+func init() {
+	for operator, op := range binaryOpcodes {
+		binaryOperations[op] = comparatorMap[operator]
+	}
+}
+
+// exprFunction is a function expressions can call, given its arguments and
+// the node being validated.  Its arguments must be of the types listed in
+// params, zero standing for any type; if variadic, the last may be
+// repeated.  Only the first required are needed.
+type exprFunction struct {
+	params   []jsonType
+	required int
+	variadic bool
+	// result is the type of the function's values, or zero if it varies.
+	result jsonType
+	call   func(node *jsonNode, args []exprElement) exprElement
+}
+
+// param returns the type the argument at position i must be of.
+func (f exprFunction) param(i int) jsonType {
+	if i >= len(f.params) {
+		i = len(f.params) - 1
+	}
+	return f.params[i]
+}
+
+// accepts reports whether a call may pass the function n arguments.
+func (f exprFunction) accepts(n int) bool {
+	return n >= f.required && (n <= len(f.params) || f.variadic)
+}
+
+// apply calls the function, or returns null if an argument is not of the
+// type it expects: unlike literals, the values of nodes can only be checked
+// once known.
+func (f exprFunction) apply(node *jsonNode, args []exprElement) exprElement {
+	for i, arg := range args {
+		if typ := f.param(i); typ != 0 && arg.typ != typ {
+			return exprElement{nil, J_NULL}
+		}
+	}
+	return f.call(node, args)
+}
+
+var exprFunctions = map[string]exprFunction{
+	// key() is the name of the node within its object, or null if it is
+	// not an object member.
+	"key": {call: func(node *jsonNode, args []exprElement) exprElement {
+		if node.parent == nil || node.parent.typ != J_OBJECT {
+			return exprElement{nil, J_NULL}
+		}
+		return exprElement{node.parentKey(), J_STRING}
+	}},
+	// index() is the position of the node within its array, counting from
+	// 0 as JSON Pointers do, or null if it is not an array element.
+	"index": {call: func(node *jsonNode, args []exprElement) exprElement {
+		if node.parent == nil || node.parent.typ != J_ARRAY {
+			return exprElement{nil, J_NULL}
+		}
+		return exprElement{float64(node.idx - 1), J_NUMBER}
+	}},
+	// siblings() is the number of elements or members of the node's
+	// parent, the node included, or null for the root.
+	"siblings": {call: func(node *jsonNode, args []exprElement) exprElement {
+		if node.parent == nil {
+			return exprElement{nil, J_NULL}
+		}
+		return exprElementSize(exprElement{node.parent.value(), node.parent.typ})
+	}},
+	// depth() is the number of ancestors of the node, 0 for the root.
+	"depth": {result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{float64(node.depth), J_NUMBER}
+	}},
+	// size(v) is the number of elements of an array or members of an
+	// object, or null for other values.
+	"size": {params: []jsonType{0}, required: 1, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElementSize(args[0])
+	}},
+	// type(v) is the name of the type of a value, as a type selector would
+	// have it.
+	"type": {params: []jsonType{0}, required: 1, result: J_STRING, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{args[0].typ.String(), J_STRING}
+	}},
+
+	"lower": stringFunction(strings.ToLower),
+	"upper": stringFunction(strings.ToUpper),
+	"trim":  stringFunction(strings.TrimSpace),
+	"len": {params: []jsonType{J_STRING}, required: 1, result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{float64(utf8.RuneCountInString(args[0].value.(string))), J_NUMBER}
+	}},
+	// substr(s, start, length) is the part of s starting at rune start,
+	// counted from the end of s if negative, and running for length runes
+	// or to the end of s.
+	"substr": {params: []jsonType{J_STRING, J_NUMBER, J_NUMBER}, required: 2, result: J_STRING, call: func(node *jsonNode, args []exprElement) exprElement {
+		runes := []rune(args[0].value.(string))
+		start := int(getFloat64(args[1].value))
+		if start < 0 {
+			start += len(runes)
+		}
+		start = min(max(start, 0), len(runes))
+		end := len(runes)
+		if len(args) > 2 {
+			end = min(start+max(int(getFloat64(args[2].value)), 0), end)
+		}
+		return exprElement{string(runes[start:end]), J_STRING}
+	}},
+	"replace": {params: []jsonType{J_STRING, J_STRING, J_STRING}, required: 3, result: J_STRING, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{strings.ReplaceAll(args[0].value.(string), args[1].value.(string), args[2].value.(string)), J_STRING}
+	}},
+	// split-count(s, separator) is the number of parts separator splits s
+	// into.
+	"split-count": {params: []jsonType{J_STRING, J_STRING}, required: 2, result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{float64(len(strings.Split(args[0].value.(string), args[1].value.(string)))), J_NUMBER}
+	}},
+
+	"abs":   numberFunction(math.Abs),
+	"floor": numberFunction(math.Floor),
+	"ceil":  numberFunction(math.Ceil),
+	// round(n) rounds halves away from zero.
+	"round": numberFunction(math.Round),
+	"min": {params: []jsonType{J_NUMBER}, required: 1, variadic: true, result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{extremum(args, math.Min), J_NUMBER}
+	}},
+	"max": {params: []jsonType{J_NUMBER}, required: 1, variadic: true, result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{extremum(args, math.Max), J_NUMBER}
+	}},
+
+	// number(v) is v if it is a number, the number a string spells out,
+	// 1 or 0 for a boolean, and null otherwise.
+	"number": {params: []jsonType{0}, required: 1, call: func(node *jsonNode, args []exprElement) exprElement {
+		switch value := args[0].value.(type) {
+		case float64, int64:
+			return exprElement{getFloat64(value), J_NUMBER}
+		case string:
+			if number, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return exprElement{number, J_NUMBER}
 			}
-			// Skip ahead an additional step more than normal
-			// since we just pulled off one more element than normal.
-			i += 1
-		} else {
-			newExpression = append(newExpression, element)
+		case bool:
+			if value {
+				return exprElement{float64(1), J_NUMBER}
+			}
+			return exprElement{float64(0), J_NUMBER}
 		}
+		return exprElement{nil, J_NULL}
+	}},
+	// string(v) is v if it is a string, and its JSON encoding otherwise.
+	"string": {params: []jsonType{0}, required: 1, result: J_STRING, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{getJsonString(args[0].value), J_STRING}
+	}},
+}
+
+// stringFunction makes an expression function of a string transformation.
+func stringFunction(transform func(string) string) exprFunction {
+	return exprFunction{params: []jsonType{J_STRING}, required: 1, result: J_STRING, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{transform(args[0].value.(string)), J_STRING}
+	}}
+}
+
+// numberFunction makes an expression function of a numeric one.
+func numberFunction(function func(float64) float64) exprFunction {
+	return exprFunction{params: []jsonType{J_NUMBER}, required: 1, result: J_NUMBER, call: func(node *jsonNode, args []exprElement) exprElement {
+		return exprElement{function(getFloat64(args[0].value)), J_NUMBER}
+	}}
+}
+
+// extremum folds numeric arguments with pick, math.Min or math.Max.
+func extremum(args []exprElement, pick func(float64, float64) float64) float64 {
+	result := getFloat64(args[0].value)
+	for _, arg := range args[1:] {
+		result = pick(result, getFloat64(arg.value))
 	}
-	return newExpression
+	return result
+}
+
+func exprElementSize(element exprElement) exprElement {
+	switch value := element.value.(type) {
+	case []interface{}:
+		return exprElement{float64(len(value)), J_NUMBER}
+	case map[string]interface{}:
+		return exprElement{float64(len(value)), J_NUMBER}
+	}
+	return exprElement{nil, J_NULL}
+}
+
+// exprPath leads from the node being validated to another: up levels
+// ancestors, then down the object members named keys.
+type exprPath struct {
+	levels int
+	keys   []string
 }
 
-func (p *Parser) evaluateExpression(elements []*exprElement) exprElement {
-	for i := 1; i <= 5; i++ {
-		elements = p.evaluateExpressionWithPrecedence(elements, i)
+// String returns the path as it is written in expressions, quoting the
+// keys that could not be written bare.
+func (path exprPath) String() string {
+	var text strings.Builder
+	for i := 0; i < path.levels; i++ {
+		if i > 0 {
+			text.WriteByte('/')
+		}
+		text.WriteString("..")
 	}
-	if len(elements) > 1 {
-		panic("More than one expression result")
+	for i, key := range path.keys {
+		if i == 0 && path.levels > 0 {
+			text.WriteByte('/')
+		} else {
+			text.WriteByte('.')
+		}
+		if isBareKey(key) {
+			text.WriteString(key)
+		} else {
+			quoted, _ := json.Marshal(key)
+			text.Write(quoted)
+		}
 	}
-	return *elements[0]
+	return text.String()
 }
 
-func (p *Parser) parseExpression(tokens []*token, node *jsonNode) exprElement {
-	var finalTokens []*exprElement
+// isBareKey reports whether key can be written unquoted and unescaped.
+func isBareKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(isLetter(c) || c == '_' || c >= utf8.RuneSelf || i > 0 && (isDigit(c) || c == '-')) {
+			return false
+		}
+	}
+	return key != ""
+}
 
-	logger.Print("Parsing expression ", getFormattedTokens(tokens))
+// expressionProduction compiles the tokens of an `:expr` argument into
+// instructions leaving the value of the expression on the stack.
+func (c *compiler) expressionProduction(tokens []*token) ([]instruction, error) {
+	code, rest, err := c.binaryExpressionProduction(tokens, 5)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New(fmt.Sprintf("Unexpected %v in expression at column %d", rest[0].val, rest[0].column))
+	}
+	return code, nil
+}
 
-	// If this expression is wrapped with parentheses, let's remove them.
-	if tokens[0].typ == S_PAREN && tokens[0].val == "(" {
-		tokens = tokens[1 : len(tokens)-1]
+// binaryExpressionProduction compiles the longest expression at the head of
+// tokens made of operators of at most the given precedence level, applying
+// operators of the same level from left to right.
+func (c *compiler) binaryExpressionProduction(tokens []*token, level int) ([]instruction, []*token, error) {
+	if level == 0 {
+		return c.operandProduction(tokens)
+	}
+	code, tokens, err := c.binaryExpressionProduction(tokens, level-1)
+	if err != nil {
+		return nil, tokens, err
 	}
+	for len(tokens) > 0 && tokens[0].typ == S_BINOP && precedenceMap[tokens[0].val.(string)] == level {
+		if tokens[0].val == "~=" {
+			// The pattern is compiled with the selector rather than for
+			// every node, so it must be a literal.
+			if len(tokens) < 2 || tokens[1].typ != S_REGEX && tokens[1].typ != S_STRING {
+				return nil, tokens, errors.New(fmt.Sprintf("Expected a regular expression after ~= at column %d", tokens[0].column))
+			}
+			re, err := c.regex(tokens[1])
+			if err != nil {
+				return nil, tokens, err
+			}
+			code = append(code, instruction{op: OP_REGEX, a: re})
+			tokens = tokens[2:]
+			continue
+		}
+		op := binaryOpcodes[tokens[0].val.(string)]
+		rhs, rest, err := c.binaryExpressionProduction(tokens[1:], level-1)
+		if err != nil {
+			return nil, rest, err
+		}
+		if op == OP_MOD && len(rhs) == 1 && rhs[0].op == OP_PUSH && c.expressionType(rhs) == J_NUMBER && getInt32(c.program.consts[rhs[0].a]) == 0 {
+			return nil, rest, errors.New(fmt.Sprintf("Remainder of a division by zero at column %d", tokens[0].column))
+		}
+		code = append(append(code, rhs...), instruction{op: op})
+		tokens = rest
+	}
+	return code, tokens, nil
+}
 
-	for i := 0; i < len(tokens); i++ {
-		thisToken := *tokens[i]
-		if thisToken.typ == S_PAREN && thisToken.val == "(" {
-			var leftCount = 0
-			var rightCount = 0
-			var j = 0
-			var subExprToken *token
-			for j, subExprToken = range tokens[i:] {
-				if subExprToken.typ == S_PAREN && subExprToken.val == "(" {
-					leftCount++
-				} else if subExprToken.typ == S_PAREN && subExprToken.val == ")" {
-					rightCount++
-				}
-				if leftCount == rightCount {
-					break
-				}
+func (c *compiler) operandProduction(tokens []*token) ([]instruction, []*token, error) {
+	if len(tokens) < 1 {
+		return nil, tokens, errors.New("Incomplete expression")
+	}
+	head := tokens[0]
+	switch head.typ {
+	case S_PAREN:
+		if head.val != "(" {
+			break
+		}
+		code, rest, err := c.binaryExpressionProduction(tokens[1:], 5)
+		if err != nil {
+			return nil, rest, err
+		}
+		if len(rest) < 1 || rest[0].typ != S_PAREN || rest[0].val != ")" {
+			return nil, rest, errors.New("Unterminated expression")
+		}
+		return code, rest[1:], nil
+	case S_PVAR:
+		return []instruction{{op: OP_PUSH_X}}, tokens[1:], nil
+	case S_FUNCTION:
+		return c.callProduction(tokens)
+	case S_PATH:
+		path := head.val.(exprPath)
+		i := c.constant(path.String())
+		if c.program.paths == nil {
+			c.program.paths = make(map[int32]exprPath)
+		}
+		c.program.paths[i] = path
+		return []instruction{{op: OP_PUSH_PATH, a: i}}, tokens[1:], nil
+	case S_STRING, S_BOOL, S_NIL, S_NUMBER:
+		return []instruction{{op: OP_PUSH, a: c.constant(head.val)}}, tokens[1:], nil
+	}
+	return nil, tokens, errors.New(fmt.Sprintf("Unexpected %v in expression at column %d", head.val, head.column))
+}
+
+// callProduction compiles a call of the function named at the head of
+// tokens, which the lexer only produces when followed by a parenthesis,
+// checking the number of its arguments and the types of those whose type
+// is known before running the expression.
+func (c *compiler) callProduction(tokens []*token) ([]instruction, []*token, error) {
+	head := tokens[0]
+	name := head.val.(string)
+	function := exprFunctions[name]
+	var code []instruction
+	var arguments int
+	tokens = tokens[2:]
+	if len(tokens) > 0 && tokens[0].typ == S_PAREN && tokens[0].val == ")" {
+		tokens = tokens[1:]
+	} else {
+		for {
+			argument, rest, err := c.binaryExpressionProduction(tokens, 5)
+			if err != nil {
+				return nil, rest, err
 			}
-			subexprResult := p.parseExpression(tokens[i:i+j+1], node)
-			finalTokens = append(finalTokens, &subexprResult)
-			// Let's move the cursor to the end of the subexpression above.
-			i = i + j
-		} else if thisToken.typ == S_PVAR {
-			// This is for the value of the node being processed.
-			finalTokens = append(finalTokens, &exprElement{node.value, node.typ})
-		} else if thisToken.typ == S_STRING || thisToken.typ == S_BOOL || thisToken.typ == S_NIL || thisToken.typ == S_NUMBER {
-			// Let's copy these kinds of tokens down as expression elements.
-			var jType jsonType
-			switch thisToken.typ {
-			case S_BOOL:
-				jType = J_BOOLEAN
-			case S_NIL:
-				jType = J_NULL
-			case S_NUMBER:
-				jType = J_NUMBER
-			default:
-				jType = J_STRING
+			arguments++
+			if typ := c.expressionType(argument); typ != 0 && (arguments <= len(function.params) || function.variadic) && function.param(arguments-1) != 0 && typ != function.param(arguments-1) {
+				return nil, rest, errors.New(fmt.Sprintf("Argument %d of %s() at column %d must be a %s, not a %s", arguments, name, head.column, function.param(arguments-1), typ))
 			}
-			finalTokens = append(finalTokens, &exprElement{thisToken.val, jType})
-		} else if thisToken.typ == S_BINOP {
-			finalTokens = append(finalTokens, &exprElement{thisToken.val, J_OPER})
-		} else {
-			logger.Print("Unexpected token ", thisToken, " ignored.")
+			code = append(code, argument...)
+			if len(rest) > 0 && rest[0].typ == S_OPER && rest[0].val == "," {
+				tokens = rest[1:]
+				continue
+			}
+			if len(rest) < 1 || rest[0].typ != S_PAREN || rest[0].val != ")" {
+				return nil, rest, errors.New(fmt.Sprintf("Unterminated call of %s() at column %d", name, head.column))
+			}
+			tokens = rest[1:]
+			break
 		}
 	}
+	if !function.accepts(arguments) {
+		return nil, tokens, errors.New(fmt.Sprintf("Wrong number of arguments to %s() at column %d: expected %s, got %d", name, head.column, function.arity(), arguments))
+	}
+	return append(code, instruction{op: OP_CALL, a: c.constant(name), b: int32(arguments)}), tokens, nil
+}
 
-	return p.evaluateExpression(finalTokens)
+// arity describes the numbers of arguments the function accepts.
+func (f exprFunction) arity() string {
+	switch {
+	case f.variadic:
+		return fmt.Sprintf("at least %d", f.required)
+	case f.required < len(f.params):
+		return fmt.Sprintf("%d to %d", f.required, len(f.params))
+	}
+	return strconv.Itoa(f.required)
+}
+
+// expressionType returns the type of the values of the compiled expression
+// code, or zero if it can only be known when running it.  It depends on
+// the last instruction, which computes the value.
+func (c *compiler) expressionType(code []instruction) jsonType {
+	last := code[len(code)-1]
+	switch {
+	case last.op == OP_PUSH:
+		switch c.program.consts[last.a].(type) {
+		case nil:
+			return J_NULL
+		case bool:
+			return J_BOOLEAN
+		case int64, float64:
+			return J_NUMBER
+		case string:
+			return J_STRING
+		}
+	case last.op == OP_CALL:
+		return exprFunctions[c.program.consts[last.a].(string)].result
+	case last.op >= OP_MUL && last.op <= OP_SUB:
+		return J_NUMBER
+	case last.op >= OP_LE && last.op <= OP_REGEX:
+		return J_BOOLEAN
+	}
+	return 0
 }
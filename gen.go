@@ -0,0 +1,40 @@
+package jsonselect
+
+import (
+	"github.com/coddingtonbear/go-jsonselect/internal/compiled"
+)
+
+func init() {
+	compiled.Steps = compiledSteps
+}
+
+// compiledSteps describes the steps of selector to the code generator of
+// jsonselect-gen, which decides which of them it can generate code for.
+func compiledSteps(selector string) ([]compiled.Step, error) {
+	program, err := Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+	steps := program.selectors[0]
+
+	described := make([]compiled.Step, 0, len(steps))
+	for _, step := range steps {
+		s := compiled.Step{Compound: step.compound, Operator: step.operator}
+		for _, validator := range step.validators {
+			condition := compiled.Condition{Kind: compiled.Other, Name: validator.name}
+			switch validator.kind {
+			case S_TYPE:
+				condition.Kind, condition.Value = compiled.Type, validator.name
+			case S_IDENTIFIER:
+				condition.Kind, condition.Value = compiled.Key, validator.name[1:]
+			case S_OPER:
+				condition.Kind = compiled.Any
+			case S_PCLASS:
+				condition.Kind = compiled.PseudoClass
+			}
+			s.Conditions = append(s.Conditions, condition)
+		}
+		described = append(described, s)
+	}
+	return described, nil
+}
@@ -0,0 +1,190 @@
+package jsonselect
+
+// hasScope is the subtree a `:has` argument is evaluated within.
+type hasScope struct {
+	node     *jsonNode
+	root     *jsonNode
+	children []*jsonNode
+}
+
+// asRoot returns the node at the top of the scope as the argument sees it:
+// the root of a document, with no parent, key or position.
+func (s *hasScope) asRoot() *jsonNode {
+	if s.root == nil {
+		root := *s.node
+		root.parent = nil
+		root.name = nil
+		root.idx = 0
+		s.root = &root
+	}
+	return s.root
+}
+
+// hasMatches runs the `:has` instruction of validator v, whose argument is
+// selector of the program.  A node has a match when one of its direct
+// children is matched by the argument evaluated within the node's subtree,
+// the node itself standing in as the root.  Since only that child and the
+// node can then take part in a combinator, checking the node's children is
+// enough, which keeps `:has` linear in the size of the document rather
+// than re-evaluating every subtree.
+//
+// An argument such as `~ .b`, relating the node itself to its following
+// siblings, is instead checked against those siblings in the document, and
+// one anchored at the node by `>` or ` `, such as `> .b > .c`, against
+// every node of its subtree, down as far as the argument reaches.
+func (p *Parser) hasMatches(m *machine, v validator, selector int32, axis int32, node *jsonNode) bool {
+	memo, ok := m.has[selector]
+	if !ok {
+		if m.has == nil {
+			m.has = make(map[int32]map[int32]bool)
+		}
+		memo = make(map[int32]bool)
+		m.has[selector] = memo
+	}
+	if matched, ok := memo[node.post]; ok {
+		return matched
+	}
+
+	steps := v.program.selectors[selector]
+	reach := scopeReach(steps)
+	var candidates []*jsonNode
+	// The candidates are either listed, or the whole of node's subtree,
+	// which lies just before it in the document map.
+	subtree := axis == hasDescendants && reach != 1
+	count := int(node.descendants)
+	switch {
+	case axis == hasFollowingSiblings && node.parent != nil:
+		candidates = p.children(node.parent)
+		for len(candidates) > 0 && candidates[0].pre() <= node.pre() {
+			candidates = candidates[1:]
+		}
+	case axis == hasDescendants && reach == 1, axis == 0:
+		candidates = p.children(node)
+	}
+	if !subtree {
+		count = len(candidates)
+	}
+	scope := hasScope{node: node, children: candidates}
+	m.profileCount("has", v.name, count)
+
+	var match *jsonNode
+	suspended := m.suspendTrace()
+	outer := m.scope
+	m.scope = node
+	m.log.IncreaseDepth()
+	for i := 0; i < count; i++ {
+		var candidate *jsonNode
+		if subtree {
+			candidate = &p.nodes[int(node.post-node.descendants)+i]
+		} else {
+			candidate = candidates[i]
+		}
+		var found bool
+		switch axis {
+		case hasFollowingSiblings:
+			found = p.selectorMatches(m, steps, 0, candidate)
+		case hasDescendants:
+			if reach == 0 || int32(candidate.depth-node.depth) <= reach {
+				found = p.scopedMatches(m, steps, len(steps)-1, candidate)
+			}
+		default:
+			found = p.hasStepMatches(m, steps, 0, &scope, candidate)
+		}
+		if found {
+			match = candidate
+			break
+		}
+	}
+	m.log.DecreaseDepth()
+	m.scope = outer
+	m.resumeTrace(suspended)
+
+	matched := match != nil
+	memo[node.post] = matched
+	m.traceHasEvaluation(node, count, match)
+	return matched
+}
+
+// hasStepMatches reports whether child is among the nodes selected by
+// steps[i:] within scope.
+func (p *Parser) hasStepMatches(m *machine, steps []*selectorStep, i int, scope *hasScope, child *jsonNode) bool {
+	step := steps[i]
+	switch step.operator {
+	case "":
+		return p.nodePassesValidators(m, step.validators, child)
+	case ",":
+		return p.nodePassesValidators(m, step.validators, child) || p.hasStepMatches(m, steps, i+1, scope, child)
+	}
+
+	if !p.hasStepMatches(m, steps, i+1, scope, child) {
+		return false
+	}
+	switch step.operator {
+	case " ":
+		return p.nodePassesValidators(m, step.validators, child) || p.nodePassesValidators(m, step.validators, scope.asRoot())
+	case ">":
+		return p.nodePassesValidators(m, step.validators, scope.asRoot())
+	case "~":
+		for _, sibling := range scope.children {
+			if sibling == child {
+				break
+			}
+			if p.nodePassesValidators(m, step.validators, sibling) {
+				return true
+			}
+		}
+	case "+":
+		previous := p.previousSibling(child)
+		return previous != nil && p.nodePassesValidators(m, step.validators, previous)
+	}
+	return false
+}
+
+// scopedMatches reports whether node is among the nodes selected by
+// steps[:i+1], an argument anchored at the scope.  Each combinator relates
+// the compound to its left to the node matched by the compound to its
+// right, so the argument can reach down through several levels of the
+// scope's subtree.
+func (p *Parser) scopedMatches(m *machine, steps []*selectorStep, i int, node *jsonNode) bool {
+	if !p.nodePassesValidators(m, steps[i].validators, node) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	switch steps[i-1].operator {
+	case " ":
+		for ancestor := node; ancestor != nil; ancestor = ancestor.parent {
+			if p.scopedMatches(m, steps, i-1, ancestor) {
+				return true
+			}
+		}
+	case ">":
+		return node.parent != nil && p.scopedMatches(m, steps, i-1, node.parent)
+	case "~":
+		for sibling := p.previousSibling(node); sibling != nil; sibling = p.previousSibling(sibling) {
+			if p.scopedMatches(m, steps, i-1, sibling) {
+				return true
+			}
+		}
+	case "+":
+		previous := p.previousSibling(node)
+		return previous != nil && p.scopedMatches(m, steps, i-1, previous)
+	}
+	return false
+}
+
+// scopeReach returns how many levels below the scope the nodes selected by
+// an argument anchored at it lie, or 0 if a ` ` lets them lie at any depth.
+func scopeReach(steps []*selectorStep) int32 {
+	var reach int32
+	for _, step := range steps {
+		switch step.operator {
+		case " ":
+			return 0
+		case ">":
+			reach++
+		}
+	}
+	return reach
+}
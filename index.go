@@ -0,0 +1,82 @@
+package jsonselect
+
+// nodeIndex maps the properties most selectors filter on to the nodes
+// having them, each list kept in document map order.
+type nodeIndex struct {
+	byKey  map[string][]*jsonNode
+	byType map[jsonType][]*jsonNode
+	roots  []*jsonNode
+	leaves []*jsonNode
+}
+
+// WithIndexes makes the parser index its nodes by key, type and root/leaf
+// status so that selectors can start from a candidate set instead of
+// scanning the whole document.  This is worthwhile when running many
+// queries against the same large document.
+func WithIndexes() Option {
+	return func(p *Parser) {
+		p.indexed = true
+	}
+}
+
+func (p *Parser) buildIndexes() {
+	index := &nodeIndex{
+		byKey:  make(map[string][]*jsonNode),
+		byType: make(map[jsonType][]*jsonNode),
+	}
+	for i := range p.nodes {
+		node := &p.nodes[i]
+		if node.parentKey() != "" {
+			index.byKey[node.parentKey()] = append(index.byKey[node.parentKey()], node)
+		}
+		index.byType[node.typ] = append(index.byType[node.typ], node)
+		if node.parent == nil {
+			index.roots = append(index.roots, node)
+		}
+		if !nodeHasChildren(node) {
+			index.leaves = append(index.leaves, node)
+		}
+	}
+	p.index = index
+}
+
+func nodeHasChildren(node *jsonNode) bool {
+	switch value := node.payload.(type) {
+	case []interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	}
+	return false
+}
+
+// candidates returns the smallest set of nodes that the indexes prove could
+// satisfy all of validators, along with the position of the validator whose
+// index provided it, or -1 if every node of the document is a candidate, in
+// which case there is no list.
+func (p *Parser) candidates(validators []validator) ([]*jsonNode, int) {
+	var candidates []*jsonNode
+	source, size := -1, len(p.nodes)
+	if p.index == nil {
+		return candidates, source
+	}
+	for i, validator := range validators {
+		var indexed []*jsonNode
+		switch {
+		case validator.kind == S_IDENTIFIER:
+			indexed = p.index.byKey[validator.name[1:]]
+		case validator.kind == S_TYPE:
+			indexed = p.index.byType[getJsonType(validator.name)]
+		case validator.name == ":root":
+			indexed = p.index.roots
+		case validator.name == ":empty":
+			indexed = p.index.leaves
+		default:
+			continue
+		}
+		if len(indexed) < size {
+			candidates, source, size = indexed, i, len(indexed)
+		}
+	}
+	return candidates, source
+}
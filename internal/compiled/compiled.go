@@ -0,0 +1,34 @@
+// Package compiled describes selectors as compiled by package jsonselect,
+// for the code generator of jsonselect-gen, without making the description
+// part of the jsonselect API.
+package compiled
+
+// Kinds of conditions.
+const (
+	Type        = "type"
+	Key         = "key"
+	Any         = "any"
+	PseudoClass = "pseudo-class"
+	Other       = "other"
+)
+
+// Step is a compound selector, as the conditions a node must satisfy, and
+// the combinator following it.
+type Step struct {
+	Compound   string
+	Conditions []Condition
+	Operator   string
+}
+
+// Condition is one component of a compound selector.  Name is as written
+// in the selector; Value is the name of the type for a Type condition and
+// the key for a Key one.
+type Condition struct {
+	Kind  string
+	Name  string
+	Value string
+}
+
+// Steps compiles selector and returns the steps of its first selector.  It
+// is set by package jsonselect when it is initialized.
+var Steps func(selector string) ([]Step, error)
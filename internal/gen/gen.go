@@ -0,0 +1,567 @@
+// Package gen generates Go functions evaluating fixed selectors, for
+// jsonselect-gen.
+package gen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+
+	// The package describes the selectors it compiles to compiled.Steps.
+	_ "github.com/coddingtonbear/go-jsonselect"
+	"github.com/coddingtonbear/go-jsonselect/internal/compiled"
+)
+
+// Selector describes a function for Go to generate.
+type Selector struct {
+	// Name is the name of the generated function.
+	Name     string
+	Selector string
+	// Bytes makes the function take a raw JSON document, scanned with
+	// jsonselect.ScanValues, rather than a decoded one.
+	Bytes bool
+}
+
+// Go returns the source of a Go file in package pkg declaring a
+// function for each of selectors, which evaluates it with code specialized
+// for it rather than by interpreting it.  Functions walking a decoded
+// document support types, keys, `*`, `:root`, `:first-child`,
+// `:last-child`, `:only-child` and every combinator; functions scanning a
+// raw one support types, keys, `*`, `:root`, `:first-child` and the child
+// and descendant combinators.  Since a decoded document no longer knows the
+// order of its keys, sibling combinators treat the members of its objects
+// as sorted by key, like a parser created by jsonselect.CreateParser.
+func Go(pkg string, selectors []Selector) ([]byte, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by jsonselect-gen; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+
+	generators := make([]*generator, 0, len(selectors))
+	var tree, raw, sorted bool
+	for _, selector := range selectors {
+		steps, err := generatorSteps(selector.Selector)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", selector.Name, err))
+		}
+		g := &generator{out: &out, name: selector.Name, prefix: lowerFirst(selector.Name), selector: selector.Selector, steps: steps}
+		generators = append(generators, g)
+		if selector.Bytes {
+			raw = true
+		} else {
+			tree = true
+			sorted = sorted || g.ordered()
+		}
+	}
+	out.WriteString("import (\n")
+	if tree {
+		out.WriteString("\t\"encoding/json\"\n")
+	}
+	if sorted {
+		out.WriteString("\t\"sort\"\n")
+	}
+	if raw {
+		out.WriteString("\n\t\"github.com/coddingtonbear/go-jsonselect\"\n")
+	}
+	out.WriteString(")\n")
+
+	for i, selector := range selectors {
+		g := generators[i]
+		var err error
+		if selector.Bytes {
+			err = g.raw()
+		} else {
+			err = g.tree()
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", selector.Name, err))
+		}
+	}
+	return format.Source(out.Bytes())
+}
+
+// GoTest returns the source of a test file, in package pkg, that checks
+// every function generated by Go for selectors returns the same values as
+// jsonselect.GetValues for each of the JSON documents matched by
+// documents, a list of filepath.Glob patterns.
+func GoTest(pkg string, selectors []Selector, documents []string) ([]byte, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by jsonselect-gen; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	out.WriteString(`import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/coddingtonbear/go-jsonselect"
+	"github.com/coddingtonbear/go-simplejson"
+)
+`)
+
+	for _, selector := range selectors {
+		if !isExported(selector.Name) {
+			return nil, errors.New(fmt.Sprintf("%s: generated tests need an exported function name", selector.Name))
+		}
+		call := "actual := " + selector.Name + "(document.Interface())"
+		if selector.Bytes {
+			call = "actual, err := " + selector.Name + "(body)\n\t\t\tif err != nil {\n\t\t\t\tt.Fatal(path, err)\n\t\t\t}"
+		}
+		fmt.Fprintf(&out, `
+// Test%[1]s checks %[1]s against the interpreter.
+func Test%[1]s(t *testing.T) {
+	var paths []string
+	for _, pattern := range %#[2]v {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(%[3]q)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		%[4]s
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%%s: %[1]s returned %%d values, the interpreter %%d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%%s: %[1]s returned %%s, the interpreter %%s", path, a[i], e[i])
+			}
+		}
+	}
+}
+`, selector.Name, documents, selector.Selector, call)
+	}
+	return format.Source(out.Bytes())
+}
+
+// generatorSteps returns the steps of selector, checking that each of
+// their conditions is one code can be generated for.
+func generatorSteps(selector string) ([]compiled.Step, error) {
+	steps, err := compiled.Steps(selector)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		for _, condition := range step.Conditions {
+			switch condition.Kind {
+			case compiled.Type, compiled.Key, compiled.Any:
+			case compiled.PseudoClass:
+				switch condition.Name {
+				case ":root", ":first-child", ":last-child", ":only-child":
+				default:
+					return nil, errors.New(fmt.Sprintf("`%s` is not supported by the code generator", condition.Name))
+				}
+			default:
+				return nil, errors.New(fmt.Sprintf("`%s` is not supported by the code generator", condition.Name))
+			}
+		}
+	}
+	return steps, nil
+}
+
+type generator struct {
+	out      *bytes.Buffer
+	name     string
+	prefix   string
+	selector string
+	steps    []compiled.Step
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(g.out, format, args...)
+}
+
+// ordered reports whether the selector relates nodes to their preceding
+// siblings, which requires walking objects in a definite order.
+func (g *generator) ordered() bool {
+	for _, step := range g.steps {
+		if step.Operator == "~" || step.Operator == "+" {
+			return true
+		}
+	}
+	return false
+}
+
+// alternatives returns the steps whose matches make up the result: those
+// followed by `,` and the last one.
+func (g *generator) alternatives() []int {
+	var alternatives []int
+	for i, step := range g.steps {
+		if step.Operator == "," || step.Operator == "" {
+			alternatives = append(alternatives, i)
+		}
+	}
+	return alternatives
+}
+
+// treeCondition returns a Go expression testing whether the node n, a
+// pointer to the generated node type, satisfies condition.
+func treeCondition(condition compiled.Condition, n string) string {
+	switch condition.Kind {
+	case compiled.Type:
+		return fmt.Sprintf("%s.typ == %q", n, condition.Value)
+	case compiled.Key:
+		if condition.Value == "" {
+			return "false"
+		}
+		return fmt.Sprintf("%s.key == %q", n, condition.Value)
+	case compiled.Any:
+		return "true"
+	}
+	switch condition.Name {
+	case ":root":
+		return n + ".parent == nil"
+	case ":first-child":
+		return n + ".idx == 1"
+	case ":last-child":
+		return fmt.Sprintf("%[1]s.siblings > 0 && %[1]s.idx == %[1]s.siblings", n)
+	}
+	return n + ".siblings == 1"
+}
+
+func (g *generator) tree() error {
+	p := g.prefix
+	alternatives := g.alternatives()
+
+	g.printf(`
+// %[1]s returns the values matched by %[2]q within document, a
+// value decoded by encoding/json or simplejson.
+func %[1]s(document interface{}) []interface{} {
+	var state %[3]sState
+	%[3]sWalk(&%[3]sNode{value: document, typ: %[3]sType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type %[3]sNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *%[3]sNode
+`, g.name, g.selector, p)
+	ordered := g.ordered()
+	if ordered {
+		g.printf(`	// pos is the node's position among its parent's members or
+	// elements, and keys the sorted keys of an object.
+	pos  int
+	keys []string
+`)
+	}
+	g.printf("}\n\ntype %sState struct {\n\tresults [%d][]interface{}\n", p, len(alternatives))
+	for i, step := range g.steps {
+		if step.Operator == "~" {
+			g.printf("\t// The parent whose children were last checked against step %d,\n\t// and the position of the first one it matched.\n", i)
+			g.printf("\tsiblingsParent%[1]d *%[2]sNode\n\tsiblingsFirst%[1]d  int\n", i, p)
+		}
+	}
+	g.printf("}\n")
+
+	if ordered {
+		g.printf(`
+func %[1]sWalk(n *%[1]sNode, state *%[1]sState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		n.keys = make([]string, 0, len(value))
+		for key := range value {
+			n.keys = append(n.keys, key)
+		}
+		sort.Strings(n.keys)
+		for i := range n.keys {
+			%[1]sWalk(%[1]sChild(n, i+1), state)
+		}
+	case []interface{}:
+		for i := range value {
+			%[1]sWalk(%[1]sChild(n, i+1), state)
+		}
+	}
+`, p)
+	} else {
+		g.printf(`
+func %[1]sWalk(n *%[1]sNode, state *%[1]sState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			%[1]sWalk(&%[1]sNode{value: child, typ: %[1]sType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			%[1]sWalk(&%[1]sNode{value: child, typ: %[1]sType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+`, p)
+	}
+	for a, j := range alternatives {
+		conditions := []string{fmt.Sprintf("%sStep%d(n)", p, j)}
+		for i := 0; i < j; i++ {
+			switch g.steps[i].Operator {
+			case " ":
+				conditions = append(conditions, fmt.Sprintf("%sAncestor%d(n)", p, i))
+			case ">":
+				conditions = append(conditions, fmt.Sprintf("n.parent != nil && %sStep%d(n.parent)", p, i))
+			case "~":
+				conditions = append(conditions, fmt.Sprintf("%sSibling%d(n, state)", p, i))
+			case "+":
+				conditions = append(conditions, fmt.Sprintf("n.pos > 1 && %sStep%d(%sChild(n.parent, n.pos-1))", p, i, p))
+			}
+		}
+		g.printf("\t// %s\n", g.steps[j].Compound)
+		g.printf("\tif %s {\n", strings.Join(conditions, " && "))
+		g.printf("\t\tstate.results[%d] = append(state.results[%d], %sValue(n.value))\n\t}\n", a, a, p)
+	}
+	g.printf("}\n")
+
+	for i, step := range g.steps {
+		var conditions []string
+		for _, condition := range step.Conditions {
+			conditions = append(conditions, treeCondition(condition, "n"))
+		}
+		g.printf("\n// %sStep%d matches `%s`.\nfunc %sStep%d(n *%sNode) bool {\n\treturn %s\n}\n", p, i, step.Compound, p, i, p, strings.Join(conditions, " && "))
+
+		switch step.Operator {
+		case " ":
+			g.printf(`
+func %[1]sAncestor%[2]d(n *%[1]sNode) bool {
+	for ; n != nil; n = n.parent {
+		if %[1]sStep%[2]d(n) {
+			return true
+		}
+	}
+	return false
+}
+`, p, i)
+		case "~":
+			g.printf(`
+func %[1]sSibling%[2]d(n *%[1]sNode, state *%[1]sState) bool {
+	parent := n.parent
+	if parent == nil {
+		return false
+	}
+	if parent != state.siblingsParent%[2]d {
+		state.siblingsParent%[2]d, state.siblingsFirst%[2]d = parent, 0
+		for pos := 1; ; pos++ {
+			child := %[1]sChild(parent, pos)
+			if child == nil {
+				break
+			}
+			if %[1]sStep%[2]d(child) {
+				state.siblingsFirst%[2]d = pos
+				break
+			}
+		}
+	}
+	return state.siblingsFirst%[2]d != 0 && state.siblingsFirst%[2]d < n.pos
+}
+`, p, i)
+		}
+	}
+
+	if ordered {
+		g.printf(`
+// %[1]sChild returns the member or element of parent at position pos, or
+// nil if it has none.
+func %[1]sChild(parent *%[1]sNode, pos int) *%[1]sNode {
+	switch value := parent.value.(type) {
+	case map[string]interface{}:
+		if pos <= len(parent.keys) {
+			key := parent.keys[pos-1]
+			return &%[1]sNode{value: value[key], typ: %[1]sType(value[key]), key: key, pos: pos, parent: parent}
+		}
+	case []interface{}:
+		if pos <= len(value) {
+			child := value[pos-1]
+			return &%[1]sNode{value: child, typ: %[1]sType(child), idx: pos, siblings: len(value), pos: pos, parent: parent}
+		}
+	}
+	return nil
+}
+`, p)
+	}
+
+	g.printf(`
+func %[1]sType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// %[1]sValue returns value as GetValues would, with numbers as float64.
+func %[1]sValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+`, p)
+	return nil
+}
+
+// rawCondition returns a Go expression testing whether frames[i] satisfies
+// condition.
+func rawCondition(condition compiled.Condition, i string) (string, error) {
+	switch condition.Kind {
+	case compiled.Type:
+		return fmt.Sprintf("frames[%s].Type() == %q", i, condition.Value), nil
+	case compiled.Key:
+		return fmt.Sprintf("frames[%s].HasKey(%q)", i, condition.Value), nil
+	case compiled.Any:
+		return "true", nil
+	}
+	switch condition.Name {
+	case ":root":
+		return i + " == 0", nil
+	case ":first-child":
+		return fmt.Sprintf("frames[%s].Index() == 1", i), nil
+	}
+	return "", errors.New(fmt.Sprintf("`%s` cannot be evaluated while scanning a raw document", condition.Name))
+}
+
+func (g *generator) raw() error {
+	p := g.prefix
+	var checks bytes.Buffer
+	last := len(g.steps) - 1
+	// Check the value itself before looking at its ancestors.
+	order := append([]int{last}, make([]int, last)...)
+	for i := range order[1:] {
+		order[i+1] = i
+	}
+	for _, i := range order {
+		step := g.steps[i]
+		var conditions []string
+		target := "last"
+		switch step.Operator {
+		case "":
+		case " ":
+			target = "i"
+		case ">":
+			target = "last - 1"
+		default:
+			return errors.New(fmt.Sprintf("the `%s` combinator cannot be evaluated while scanning a raw document", step.Operator))
+		}
+		for _, condition := range step.Conditions {
+			expression, err := rawCondition(condition, target)
+			if err != nil {
+				return err
+			}
+			if expression != "true" {
+				conditions = append(conditions, expression)
+			}
+		}
+		condition := strings.Join(conditions, " && ")
+		negated := "!(" + condition + ")"
+		if len(conditions) == 1 && strings.HasSuffix(condition, ")") {
+			negated = "!" + condition
+		}
+
+		fmt.Fprintf(&checks, "\t// %s\n", step.Compound)
+		switch {
+		case len(conditions) == 0 && step.Operator == ">":
+			fmt.Fprintf(&checks, "\tif last == 0 {\n\t\treturn false\n\t}\n")
+		case len(conditions) == 0:
+			// Every value, and so every ancestor, matches.
+		case i == last:
+			fmt.Fprintf(&checks, "\tif %s {\n\t\treturn false\n\t}\n", negated)
+		case step.Operator == ">":
+			fmt.Fprintf(&checks, "\tif last == 0 || %s {\n\t\treturn false\n\t}\n", negated)
+		default:
+			fmt.Fprintf(&checks, "\tfor i := last; ; i-- {\n\t\tif i < 0 {\n\t\t\treturn false\n\t\t}\n\t\tif %s {\n\t\t\tbreak\n\t\t}\n\t}\n", condition)
+		}
+	}
+
+	g.printf(`
+// %[1]s returns the values matched by %[2]q within the JSON
+// document in body.
+func %[1]s(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, %[3]sSelected)
+}
+
+func %[3]sSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+%[4]s	return true
+}
+`, g.name, g.selector, p, checks.String())
+	return nil
+}
+
+func lowerFirst(name string) string {
+	for i, r := range name {
+		return string(unicode.ToLower(r)) + name[i+len(string(r)):]
+	}
+	return name
+}
+
+func isExported(name string) bool {
+	for _, r := range name {
+		return unicode.IsUpper(r)
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGo(t *testing.T) {
+	source, err := Go("example", []Selector{
+		{Name: "Names", Selector: ".items > object .name, :root > string"},
+		{Name: "RawNames", Selector: ".items > object .name", Bytes: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"func Names(document interface{}) []interface{}", "func RawNames(body []byte) ([]interface{}, error)"} {
+		if !strings.Contains(string(source), expected) {
+			t.Error("Expected generated code to declare ", expected)
+		}
+	}
+
+	for _, unsupported := range []Selector{
+		{Name: "Has", Selector: "object:has(.name)"},
+		{Name: "Expr", Selector: ".age:expr(x > 3)"},
+		{Name: "Siblings", Selector: ".a ~ .b", Bytes: true},
+		{Name: "Last", Selector: ".a:last-child", Bytes: true},
+	} {
+		if _, err := Go("example", []Selector{unsupported}); err == nil {
+			t.Error("Expected ", unsupported.Selector, " not to be generated")
+		}
+	}
+
+	if _, err := GoTest("example", []Selector{{Name: "names", Selector: ".name"}}, nil); err == nil {
+		t.Error("Expected a test for an unexported function to be refused")
+	}
+}
@@ -0,0 +1,7 @@
+// Package example shows the jsonselect-gen workflow: the functions below
+// are generated by running `go generate`, which also generates tests
+// checking them against the interpreter on the repository's test documents.
+package example
+
+//go:generate go run github.com/coddingtonbear/go-jsonselect/jsonselect-gen -o selectors_gen.go -test -documents ../../test_data/*.json,../../test_data/extra/*.json,../../conformance_tests/*/*.json "Names=.name" "ChildNames=.child > * > .name" "LinkHrefs=.links > object > .href" "FirstLinks=.links > :first-child" "SiblingNames=.hat ~ .name" "AdjacentNames=.hat + .name" "NamesAndAges=object .name, .age" "LinkKeywords=:root .Link string"
+//go:generate go run github.com/coddingtonbear/go-jsonselect/jsonselect-gen -o raw_selectors_gen.go -bytes -test -documents ../../test_data/*.json,../../test_data/extra/*.json,../../conformance_tests/*/*.json "RawNames=.name" "RawChildNames=.child > * > .name" "RawLinkHrefs=.links > object > .href" "RawFirstLinks=.links > :first-child" "RawLinkKeywords=:root .Link string"
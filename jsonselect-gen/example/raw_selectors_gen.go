@@ -0,0 +1,120 @@
+// Code generated by jsonselect-gen; DO NOT EDIT.
+
+package example
+
+import (
+	"github.com/coddingtonbear/go-jsonselect"
+)
+
+// RawNames returns the values matched by ".name" within the JSON
+// document in body.
+func RawNames(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, rawNamesSelected)
+}
+
+func rawNamesSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+	// .name
+	if !frames[last].HasKey("name") {
+		return false
+	}
+	return true
+}
+
+// RawChildNames returns the values matched by ".child > * > .name" within the JSON
+// document in body.
+func RawChildNames(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, rawChildNamesSelected)
+}
+
+func rawChildNamesSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+	// .name
+	if !frames[last].HasKey("name") {
+		return false
+	}
+	// .child
+	if last == 0 || !frames[last-1].HasKey("child") {
+		return false
+	}
+	// *
+	if last == 0 {
+		return false
+	}
+	return true
+}
+
+// RawLinkHrefs returns the values matched by ".links > object > .href" within the JSON
+// document in body.
+func RawLinkHrefs(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, rawLinkHrefsSelected)
+}
+
+func rawLinkHrefsSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+	// .href
+	if !frames[last].HasKey("href") {
+		return false
+	}
+	// .links
+	if last == 0 || !frames[last-1].HasKey("links") {
+		return false
+	}
+	// object
+	if last == 0 || !(frames[last-1].Type() == "object") {
+		return false
+	}
+	return true
+}
+
+// RawFirstLinks returns the values matched by ".links > :first-child" within the JSON
+// document in body.
+func RawFirstLinks(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, rawFirstLinksSelected)
+}
+
+func rawFirstLinksSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+	// :first-child
+	if !(frames[last].Index() == 1) {
+		return false
+	}
+	// .links
+	if last == 0 || !frames[last-1].HasKey("links") {
+		return false
+	}
+	return true
+}
+
+// RawLinkKeywords returns the values matched by ":root .Link string" within the JSON
+// document in body.
+func RawLinkKeywords(body []byte) ([]interface{}, error) {
+	return jsonselect.ScanValues(body, rawLinkKeywordsSelected)
+}
+
+func rawLinkKeywordsSelected(frames []jsonselect.RawFrame) bool {
+	last := len(frames) - 1
+	// string
+	if !(frames[last].Type() == "string") {
+		return false
+	}
+	// :root
+	for i := last; ; i-- {
+		if i < 0 {
+			return false
+		}
+		if i == 0 {
+			break
+		}
+	}
+	// .Link
+	for i := last; ; i-- {
+		if i < 0 {
+			return false
+		}
+		if frames[i].HasKey("Link") {
+			break
+		}
+	}
+	return true
+}
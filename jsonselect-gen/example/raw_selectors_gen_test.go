@@ -0,0 +1,274 @@
+// Code generated by jsonselect-gen; DO NOT EDIT.
+
+package example
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/coddingtonbear/go-jsonselect"
+	"github.com/coddingtonbear/go-simplejson"
+)
+
+// TestRawNames checks RawNames against the interpreter.
+func TestRawNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual, err := RawNames(body)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: RawNames returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: RawNames returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestRawChildNames checks RawChildNames against the interpreter.
+func TestRawChildNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".child > * > .name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual, err := RawChildNames(body)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: RawChildNames returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: RawChildNames returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestRawLinkHrefs checks RawLinkHrefs against the interpreter.
+func TestRawLinkHrefs(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".links > object > .href")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual, err := RawLinkHrefs(body)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: RawLinkHrefs returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: RawLinkHrefs returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestRawFirstLinks checks RawFirstLinks against the interpreter.
+func TestRawFirstLinks(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".links > :first-child")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual, err := RawFirstLinks(body)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: RawFirstLinks returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: RawFirstLinks returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestRawLinkKeywords checks RawLinkKeywords against the interpreter.
+func TestRawLinkKeywords(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(":root .Link string")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual, err := RawLinkKeywords(body)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: RawLinkKeywords returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: RawLinkKeywords returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
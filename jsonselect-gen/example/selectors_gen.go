@@ -0,0 +1,957 @@
+// Code generated by jsonselect-gen; DO NOT EDIT.
+
+package example
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Names returns the values matched by ".name" within document, a
+// value decoded by encoding/json or simplejson.
+func Names(document interface{}) []interface{} {
+	var state namesState
+	namesWalk(&namesNode{value: document, typ: namesType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type namesNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *namesNode
+}
+
+type namesState struct {
+	results [1][]interface{}
+}
+
+func namesWalk(n *namesNode, state *namesState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			namesWalk(&namesNode{value: child, typ: namesType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			namesWalk(&namesNode{value: child, typ: namesType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// .name
+	if namesStep0(n) {
+		state.results[0] = append(state.results[0], namesValue(n.value))
+	}
+}
+
+// namesStep0 matches `.name`.
+func namesStep0(n *namesNode) bool {
+	return n.key == "name"
+}
+
+func namesType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// namesValue returns value as GetValues would, with numbers as float64.
+func namesValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// ChildNames returns the values matched by ".child > * > .name" within document, a
+// value decoded by encoding/json or simplejson.
+func ChildNames(document interface{}) []interface{} {
+	var state childNamesState
+	childNamesWalk(&childNamesNode{value: document, typ: childNamesType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type childNamesNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *childNamesNode
+}
+
+type childNamesState struct {
+	results [1][]interface{}
+}
+
+func childNamesWalk(n *childNamesNode, state *childNamesState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			childNamesWalk(&childNamesNode{value: child, typ: childNamesType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			childNamesWalk(&childNamesNode{value: child, typ: childNamesType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// .name
+	if childNamesStep2(n) && n.parent != nil && childNamesStep0(n.parent) && n.parent != nil && childNamesStep1(n.parent) {
+		state.results[0] = append(state.results[0], childNamesValue(n.value))
+	}
+}
+
+// childNamesStep0 matches `.child`.
+func childNamesStep0(n *childNamesNode) bool {
+	return n.key == "child"
+}
+
+// childNamesStep1 matches `*`.
+func childNamesStep1(n *childNamesNode) bool {
+	return true
+}
+
+// childNamesStep2 matches `.name`.
+func childNamesStep2(n *childNamesNode) bool {
+	return n.key == "name"
+}
+
+func childNamesType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// childNamesValue returns value as GetValues would, with numbers as float64.
+func childNamesValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// LinkHrefs returns the values matched by ".links > object > .href" within document, a
+// value decoded by encoding/json or simplejson.
+func LinkHrefs(document interface{}) []interface{} {
+	var state linkHrefsState
+	linkHrefsWalk(&linkHrefsNode{value: document, typ: linkHrefsType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type linkHrefsNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *linkHrefsNode
+}
+
+type linkHrefsState struct {
+	results [1][]interface{}
+}
+
+func linkHrefsWalk(n *linkHrefsNode, state *linkHrefsState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			linkHrefsWalk(&linkHrefsNode{value: child, typ: linkHrefsType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			linkHrefsWalk(&linkHrefsNode{value: child, typ: linkHrefsType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// .href
+	if linkHrefsStep2(n) && n.parent != nil && linkHrefsStep0(n.parent) && n.parent != nil && linkHrefsStep1(n.parent) {
+		state.results[0] = append(state.results[0], linkHrefsValue(n.value))
+	}
+}
+
+// linkHrefsStep0 matches `.links`.
+func linkHrefsStep0(n *linkHrefsNode) bool {
+	return n.key == "links"
+}
+
+// linkHrefsStep1 matches `object`.
+func linkHrefsStep1(n *linkHrefsNode) bool {
+	return n.typ == "object"
+}
+
+// linkHrefsStep2 matches `.href`.
+func linkHrefsStep2(n *linkHrefsNode) bool {
+	return n.key == "href"
+}
+
+func linkHrefsType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// linkHrefsValue returns value as GetValues would, with numbers as float64.
+func linkHrefsValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// FirstLinks returns the values matched by ".links > :first-child" within document, a
+// value decoded by encoding/json or simplejson.
+func FirstLinks(document interface{}) []interface{} {
+	var state firstLinksState
+	firstLinksWalk(&firstLinksNode{value: document, typ: firstLinksType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type firstLinksNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *firstLinksNode
+}
+
+type firstLinksState struct {
+	results [1][]interface{}
+}
+
+func firstLinksWalk(n *firstLinksNode, state *firstLinksState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			firstLinksWalk(&firstLinksNode{value: child, typ: firstLinksType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			firstLinksWalk(&firstLinksNode{value: child, typ: firstLinksType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// :first-child
+	if firstLinksStep1(n) && n.parent != nil && firstLinksStep0(n.parent) {
+		state.results[0] = append(state.results[0], firstLinksValue(n.value))
+	}
+}
+
+// firstLinksStep0 matches `.links`.
+func firstLinksStep0(n *firstLinksNode) bool {
+	return n.key == "links"
+}
+
+// firstLinksStep1 matches `:first-child`.
+func firstLinksStep1(n *firstLinksNode) bool {
+	return n.idx == 1
+}
+
+func firstLinksType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// firstLinksValue returns value as GetValues would, with numbers as float64.
+func firstLinksValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// SiblingNames returns the values matched by ".hat ~ .name" within document, a
+// value decoded by encoding/json or simplejson.
+func SiblingNames(document interface{}) []interface{} {
+	var state siblingNamesState
+	siblingNamesWalk(&siblingNamesNode{value: document, typ: siblingNamesType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type siblingNamesNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *siblingNamesNode
+	// pos is the node's position among its parent's members or
+	// elements, and keys the sorted keys of an object.
+	pos  int
+	keys []string
+}
+
+type siblingNamesState struct {
+	results [1][]interface{}
+	// The parent whose children were last checked against step 0,
+	// and the position of the first one it matched.
+	siblingsParent0 *siblingNamesNode
+	siblingsFirst0  int
+}
+
+func siblingNamesWalk(n *siblingNamesNode, state *siblingNamesState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		n.keys = make([]string, 0, len(value))
+		for key := range value {
+			n.keys = append(n.keys, key)
+		}
+		sort.Strings(n.keys)
+		for i := range n.keys {
+			siblingNamesWalk(siblingNamesChild(n, i+1), state)
+		}
+	case []interface{}:
+		for i := range value {
+			siblingNamesWalk(siblingNamesChild(n, i+1), state)
+		}
+	}
+	// .name
+	if siblingNamesStep1(n) && siblingNamesSibling0(n, state) {
+		state.results[0] = append(state.results[0], siblingNamesValue(n.value))
+	}
+}
+
+// siblingNamesStep0 matches `.hat`.
+func siblingNamesStep0(n *siblingNamesNode) bool {
+	return n.key == "hat"
+}
+
+func siblingNamesSibling0(n *siblingNamesNode, state *siblingNamesState) bool {
+	parent := n.parent
+	if parent == nil {
+		return false
+	}
+	if parent != state.siblingsParent0 {
+		state.siblingsParent0, state.siblingsFirst0 = parent, 0
+		for pos := 1; ; pos++ {
+			child := siblingNamesChild(parent, pos)
+			if child == nil {
+				break
+			}
+			if siblingNamesStep0(child) {
+				state.siblingsFirst0 = pos
+				break
+			}
+		}
+	}
+	return state.siblingsFirst0 != 0 && state.siblingsFirst0 < n.pos
+}
+
+// siblingNamesStep1 matches `.name`.
+func siblingNamesStep1(n *siblingNamesNode) bool {
+	return n.key == "name"
+}
+
+// siblingNamesChild returns the member or element of parent at position pos, or
+// nil if it has none.
+func siblingNamesChild(parent *siblingNamesNode, pos int) *siblingNamesNode {
+	switch value := parent.value.(type) {
+	case map[string]interface{}:
+		if pos <= len(parent.keys) {
+			key := parent.keys[pos-1]
+			return &siblingNamesNode{value: value[key], typ: siblingNamesType(value[key]), key: key, pos: pos, parent: parent}
+		}
+	case []interface{}:
+		if pos <= len(value) {
+			child := value[pos-1]
+			return &siblingNamesNode{value: child, typ: siblingNamesType(child), idx: pos, siblings: len(value), pos: pos, parent: parent}
+		}
+	}
+	return nil
+}
+
+func siblingNamesType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// siblingNamesValue returns value as GetValues would, with numbers as float64.
+func siblingNamesValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// AdjacentNames returns the values matched by ".hat + .name" within document, a
+// value decoded by encoding/json or simplejson.
+func AdjacentNames(document interface{}) []interface{} {
+	var state adjacentNamesState
+	adjacentNamesWalk(&adjacentNamesNode{value: document, typ: adjacentNamesType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type adjacentNamesNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *adjacentNamesNode
+	// pos is the node's position among its parent's members or
+	// elements, and keys the sorted keys of an object.
+	pos  int
+	keys []string
+}
+
+type adjacentNamesState struct {
+	results [1][]interface{}
+}
+
+func adjacentNamesWalk(n *adjacentNamesNode, state *adjacentNamesState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		n.keys = make([]string, 0, len(value))
+		for key := range value {
+			n.keys = append(n.keys, key)
+		}
+		sort.Strings(n.keys)
+		for i := range n.keys {
+			adjacentNamesWalk(adjacentNamesChild(n, i+1), state)
+		}
+	case []interface{}:
+		for i := range value {
+			adjacentNamesWalk(adjacentNamesChild(n, i+1), state)
+		}
+	}
+	// .name
+	if adjacentNamesStep1(n) && n.pos > 1 && adjacentNamesStep0(adjacentNamesChild(n.parent, n.pos-1)) {
+		state.results[0] = append(state.results[0], adjacentNamesValue(n.value))
+	}
+}
+
+// adjacentNamesStep0 matches `.hat`.
+func adjacentNamesStep0(n *adjacentNamesNode) bool {
+	return n.key == "hat"
+}
+
+// adjacentNamesStep1 matches `.name`.
+func adjacentNamesStep1(n *adjacentNamesNode) bool {
+	return n.key == "name"
+}
+
+// adjacentNamesChild returns the member or element of parent at position pos, or
+// nil if it has none.
+func adjacentNamesChild(parent *adjacentNamesNode, pos int) *adjacentNamesNode {
+	switch value := parent.value.(type) {
+	case map[string]interface{}:
+		if pos <= len(parent.keys) {
+			key := parent.keys[pos-1]
+			return &adjacentNamesNode{value: value[key], typ: adjacentNamesType(value[key]), key: key, pos: pos, parent: parent}
+		}
+	case []interface{}:
+		if pos <= len(value) {
+			child := value[pos-1]
+			return &adjacentNamesNode{value: child, typ: adjacentNamesType(child), idx: pos, siblings: len(value), pos: pos, parent: parent}
+		}
+	}
+	return nil
+}
+
+func adjacentNamesType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// adjacentNamesValue returns value as GetValues would, with numbers as float64.
+func adjacentNamesValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// NamesAndAges returns the values matched by "object .name, .age" within document, a
+// value decoded by encoding/json or simplejson.
+func NamesAndAges(document interface{}) []interface{} {
+	var state namesAndAgesState
+	namesAndAgesWalk(&namesAndAgesNode{value: document, typ: namesAndAgesType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type namesAndAgesNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *namesAndAgesNode
+}
+
+type namesAndAgesState struct {
+	results [2][]interface{}
+}
+
+func namesAndAgesWalk(n *namesAndAgesNode, state *namesAndAgesState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			namesAndAgesWalk(&namesAndAgesNode{value: child, typ: namesAndAgesType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			namesAndAgesWalk(&namesAndAgesNode{value: child, typ: namesAndAgesType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// .name
+	if namesAndAgesStep1(n) && namesAndAgesAncestor0(n) {
+		state.results[0] = append(state.results[0], namesAndAgesValue(n.value))
+	}
+	// .age
+	if namesAndAgesStep2(n) && namesAndAgesAncestor0(n) {
+		state.results[1] = append(state.results[1], namesAndAgesValue(n.value))
+	}
+}
+
+// namesAndAgesStep0 matches `object`.
+func namesAndAgesStep0(n *namesAndAgesNode) bool {
+	return n.typ == "object"
+}
+
+func namesAndAgesAncestor0(n *namesAndAgesNode) bool {
+	for ; n != nil; n = n.parent {
+		if namesAndAgesStep0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// namesAndAgesStep1 matches `.name`.
+func namesAndAgesStep1(n *namesAndAgesNode) bool {
+	return n.key == "name"
+}
+
+// namesAndAgesStep2 matches `.age`.
+func namesAndAgesStep2(n *namesAndAgesNode) bool {
+	return n.key == "age"
+}
+
+func namesAndAgesType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// namesAndAgesValue returns value as GetValues would, with numbers as float64.
+func namesAndAgesValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
+
+// LinkKeywords returns the values matched by ":root .Link string" within document, a
+// value decoded by encoding/json or simplejson.
+func LinkKeywords(document interface{}) []interface{} {
+	var state linkKeywordsState
+	linkKeywordsWalk(&linkKeywordsNode{value: document, typ: linkKeywordsType(document)}, &state)
+	results := make([]interface{}, 0)
+	for _, matched := range state.results {
+		results = append(results, matched...)
+	}
+	return results
+}
+
+type linkKeywordsNode struct {
+	value         interface{}
+	typ           string
+	key           string
+	idx, siblings int
+	parent        *linkKeywordsNode
+}
+
+type linkKeywordsState struct {
+	results [1][]interface{}
+}
+
+func linkKeywordsWalk(n *linkKeywordsNode, state *linkKeywordsState) {
+	switch value := n.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			linkKeywordsWalk(&linkKeywordsNode{value: child, typ: linkKeywordsType(child), key: key, parent: n}, state)
+		}
+	case []interface{}:
+		for i, child := range value {
+			linkKeywordsWalk(&linkKeywordsNode{value: child, typ: linkKeywordsType(child), idx: i + 1, siblings: len(value), parent: n}, state)
+		}
+	}
+	// string
+	if linkKeywordsStep2(n) && linkKeywordsAncestor0(n) && linkKeywordsAncestor1(n) {
+		state.results[0] = append(state.results[0], linkKeywordsValue(n.value))
+	}
+}
+
+// linkKeywordsStep0 matches `:root`.
+func linkKeywordsStep0(n *linkKeywordsNode) bool {
+	return n.parent == nil
+}
+
+func linkKeywordsAncestor0(n *linkKeywordsNode) bool {
+	for ; n != nil; n = n.parent {
+		if linkKeywordsStep0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkKeywordsStep1 matches `.Link`.
+func linkKeywordsStep1(n *linkKeywordsNode) bool {
+	return n.key == "Link"
+}
+
+func linkKeywordsAncestor1(n *linkKeywordsNode) bool {
+	for ; n != nil; n = n.parent {
+		if linkKeywordsStep1(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkKeywordsStep2 matches `string`.
+func linkKeywordsStep2(n *linkKeywordsNode) bool {
+	return n.typ == "string"
+}
+
+func linkKeywordsType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// linkKeywordsValue returns value as GetValues would, with numbers as float64.
+func linkKeywordsValue(value interface{}) interface{} {
+	switch number := value.(type) {
+	case json.Number:
+		f, _ := number.Float64()
+		return f
+	case float32:
+		return float64(number)
+	case int:
+		return float64(number)
+	case int8:
+		return float64(number)
+	case int16:
+		return float64(number)
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case uint:
+		return float64(number)
+	case uint8:
+		return float64(number)
+	case uint16:
+		return float64(number)
+	case uint32:
+		return float64(number)
+	case uint64:
+		return float64(number)
+	case uintptr:
+		return float64(number)
+	}
+	return value
+}
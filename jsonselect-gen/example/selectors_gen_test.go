@@ -0,0 +1,406 @@
+// Code generated by jsonselect-gen; DO NOT EDIT.
+
+package example
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/coddingtonbear/go-jsonselect"
+	"github.com/coddingtonbear/go-simplejson"
+)
+
+// TestNames checks Names against the interpreter.
+func TestNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := Names(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: Names returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: Names returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestChildNames checks ChildNames against the interpreter.
+func TestChildNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".child > * > .name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := ChildNames(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: ChildNames returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: ChildNames returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestLinkHrefs checks LinkHrefs against the interpreter.
+func TestLinkHrefs(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".links > object > .href")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := LinkHrefs(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: LinkHrefs returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: LinkHrefs returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestFirstLinks checks FirstLinks against the interpreter.
+func TestFirstLinks(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".links > :first-child")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := FirstLinks(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: FirstLinks returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: FirstLinks returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestSiblingNames checks SiblingNames against the interpreter.
+func TestSiblingNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".hat ~ .name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := SiblingNames(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: SiblingNames returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: SiblingNames returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestAdjacentNames checks AdjacentNames against the interpreter.
+func TestAdjacentNames(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(".hat + .name")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := AdjacentNames(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: AdjacentNames returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: AdjacentNames returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestNamesAndAges checks NamesAndAges against the interpreter.
+func TestNamesAndAges(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues("object .name, .age")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := NamesAndAges(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: NamesAndAges returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: NamesAndAges returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
+
+// TestLinkKeywords checks LinkKeywords against the interpreter.
+func TestLinkKeywords(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"../../test_data/*.json", "../../test_data/extra/*.json", "../../conformance_tests/*/*.json"} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		t.Skip("no documents found")
+	}
+
+	encode := func(values []interface{}) []string {
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			encoded = append(encoded, string(b))
+		}
+		sort.Strings(encoded)
+		return encoded
+	}
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := simplejson.NewJson(body)
+		if err != nil {
+			continue
+		}
+		parser, _ := jsonselect.CreateParser(document)
+		expected, err := parser.GetValues(":root .Link string")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		actual := LinkKeywords(document.Interface())
+
+		e, a := encode(expected), encode(actual)
+		if len(e) != len(a) {
+			t.Errorf("%s: LinkKeywords returned %d values, the interpreter %d", path, len(a), len(e))
+			continue
+		}
+		for i := range e {
+			if e[i] != a[i] {
+				t.Errorf("%s: LinkKeywords returned %s, the interpreter %s", path, a[i], e[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/coddingtonbear/go-jsonselect/internal/gen"
+)
+
+func main() {
+	var output string
+	var pkg string
+	var raw bool
+	var test bool
+	var documents string
+
+	log.SetFlags(0)
+	log.SetPrefix("jsonselect-gen: ")
+
+	flag.StringVar(&output, "o", "", "Write the generated code to this file instead of stdout")
+	flag.StringVar(&pkg, "package", os.Getenv("GOPACKAGE"), "Package of the generated code; defaults to $GOPACKAGE, set by go generate")
+	flag.BoolVar(&raw, "bytes", false, "Generate functions scanning raw JSON documents instead of decoded ones")
+	flag.BoolVar(&test, "test", false, "Also generate a test checking the functions against the interpreter; requires -o")
+	flag.StringVar(&documents, "documents", "", "Comma-separated glob patterns of the JSON documents the test runs against")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: jsonselect-gen [flags] Name=selector...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if pkg == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var selectors []gen.Selector
+	for _, arg := range flag.Args() {
+		name, selector, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || selector == "" {
+			log.Fatalf("expected Name=selector, got %q", arg)
+		}
+		selectors = append(selectors, gen.Selector{Name: name, Selector: selector, Bytes: raw})
+	}
+
+	source, err := gen.Go(pkg, selectors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if output == "" {
+		os.Stdout.Write(source)
+	} else if err := os.WriteFile(output, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	if test {
+		if output == "" || documents == "" {
+			log.Fatal("-test requires -o and -documents")
+		}
+		source, err := gen.GoTest(pkg, selectors, strings.Split(documents, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(strings.TrimSuffix(output, ".go")+"_test.go", source, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
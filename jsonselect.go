@@ -2,9 +2,12 @@ package jsonselect
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -12,45 +15,106 @@ import (
 )
 
 type Parser struct {
-	Data  *simplejson.Json
-	nodes []*jsonNode
+	Data *simplejson.Json
+	// nodes is the document map, every node of the document in post-order.
+	nodes   []jsonNode
+	log     logHandler
+	profile *Profiler
+	indexed bool
+	index   *nodeIndex
+	stats   documentStats
 }
 
-func CreateParserFromString(body string) (*Parser, error) {
-	json, err := simplejson.NewJson([]byte(body))
+// Option configures optional behaviour of a Parser at creation time.
+type Option func(*Parser)
+
+// WithLogger routes the parser's trace events to logger as debug-level
+// records instead of the package-wide logger set up by EnableLogger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *Parser) {
+		p.log.logger = logger
+	}
+}
+
+func CreateParserFromString(body string, opts ...Option) (*Parser, error) {
+	data := []byte(body)
+	json, err := simplejson.NewJson(data)
 	if err != nil {
 		return nil, err
 	}
-	parser := Parser{json, nil}
-	parser.mapDocument()
-	return &parser, err
+	return newParser(json, data, opts), nil
 }
 
-func CreateParser(json *simplejson.Json) (*Parser, error) {
+// CreateParser returns a parser for an already decoded document.  Having
+// lost the order of the keys of its objects, it treats their members as
+// if they were sorted by key.
+func CreateParser(json *simplejson.Json, opts ...Option) (*Parser, error) {
 	log.SetOutput(ioutil.Discard)
-	parser := Parser{json, nil}
-	parser.mapDocument()
-	return &parser, nil
+	return newParser(json, nil, opts), nil
 }
 
-func (p *Parser) evaluateSelector(selector string) ([]*jsonNode, error) {
-	tokens, err := lex(selector, selectorScanner)
-	if err != nil {
-		return nil, err
+// newParser maps the document json, decoded from source if it is not nil,
+// which is only needed until then.
+func newParser(json *simplejson.Json, source []byte, opts []Option) *Parser {
+	parser := Parser{Data: json}
+	for _, opt := range opts {
+		opt(&parser)
+	}
+	parser.mapDocument(source)
+	if parser.indexed {
+		parser.buildIndexes()
+	}
+	return &parser
+}
+
+// evaluateProgram runs program against the document, recording how into
+// trace if it is not nil.  Everything a single evaluation changes lives in
+// a machine of its own, so any number may run on the parser at once.
+func (p *Parser) evaluateProgram(program *Program, trace *traceRecorder) ([]*jsonNode, error) {
+	selector := program.selector
+	m := &machine{log: p.log, trace: trace}
+	if program.logger != nil {
+		m.log.logger = program.logger
+	}
+	m.logging = m.log.Enabled()
+	if m.logging {
+		m.log.Trace("compiled selector", "selector", selector, "program", program.String())
+	}
+
+	steps := program.steps()
+	plan := p.planSelector(selector, steps)
+	if m.logging {
+		m.log.Trace("selector planned", "selector", selector, "plan", plan.String())
 	}
 
-	nodes, err := p.selectorProduction(tokens, p.nodes, 1)
+	if p.profile != nil {
+		m.profile = newProfileState(p.profile)
+	}
+	nodes, err := p.executeStep(m, steps, 0)
+	if m.profile != nil {
+		p.profile.flush(m.profile.counts)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Print(len(nodes), " matches found")
+	m.log.Trace("selector evaluated", "selector", selector, "matches", len(nodes))
 
 	return nodes, nil
 }
 
 func (p *Parser) GetJsonElements(selector string) ([]*simplejson.Json, error) {
-	nodes, err := p.evaluateSelector(selector)
+	program, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetCompiledJsonElements(program)
+}
+
+// GetCompiledJsonElements is GetJsonElements for a selector compiled with
+// Compile.
+func (p *Parser) GetCompiledJsonElements(program *Program) ([]*simplejson.Json, error) {
+	nodes, err := p.evaluateProgram(program, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -59,14 +123,23 @@ func (p *Parser) GetJsonElements(selector string) ([]*simplejson.Json, error) {
 	for _, node := range nodes {
 		results = append(
 			results,
-			node.json,
+			p.getJsonElement(node),
 		)
 	}
 	return results, nil
 }
 
 func (p *Parser) GetValues(selector string) ([]interface{}, error) {
-	nodes, err := p.evaluateSelector(selector)
+	program, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetCompiledValues(program)
+}
+
+// GetCompiledValues is GetValues for a selector compiled with Compile.
+func (p *Parser) GetCompiledValues(program *Program) ([]interface{}, error) {
+	nodes, err := p.evaluateProgram(program, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -75,128 +148,358 @@ func (p *Parser) GetValues(selector string) ([]interface{}, error) {
 	for _, node := range nodes {
 		results = append(
 			results,
-			node.value,
+			node.value(),
 		)
 	}
 
 	return results, nil
 }
 
-func (p *Parser) selectorProduction(tokens []*token, documentMap []*jsonNode, recursionDepth int) ([]*jsonNode, error) {
-	var results []*jsonNode
-	var matched bool
-	var value interface{}
-	var validator func(*jsonNode) bool
-	var validators = make([]func(*jsonNode) bool, 0, 10)
-	if len(tokens) > 0 {
-		logger.Print("selectorProduction(", recursionDepth, ") starting with ", tokens[0], " - ", len(tokens), " tokens remaining.")
+// validator is one component of a compound selector, named after the
+// selector text it was compiled from; its predicates are the instructions
+// of program from start to end.
+type validator struct {
+	name    string
+	kind    tokenType
+	program *Program
+	start   int
+	end     int
+}
+
+// compiledValidator is a validator being compiled, before its code is laid
+// out in a program.
+type compiledValidator struct {
+	validator
+	code []instruction
+}
+
+// compiler translates the tokens of a selector into a Program.
+type compiler struct {
+	program *Program
+	consts  map[interface{}]int32
+	// selectors holds the code of each selector of the program, in the
+	// order they are laid out.
+	selectors [][]instruction
+}
+
+// Compile translates selector into a Program, which can be evaluated
+// against any number of documents with GetCompiledValues.  Of the options,
+// only WithLogger applies to a program: its trace events then go to that
+// logger whichever parser evaluates it.
+func Compile(selector string, opts ...Option) (*Program, error) {
+	tokens, err := lex(selector, selectorScanner)
+	if err != nil {
+		return nil, err
 	}
 
-	_, matched, _ = p.peek(tokens, S_TYPE)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_TYPE)
-		validators = append(
-			validators,
-			p.typeProduction(value),
-		)
+	var settings Parser
+	for _, opt := range opts {
+		opt(&settings)
 	}
-	_, matched, _ = p.peek(tokens, S_IDENTIFIER)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_IDENTIFIER)
-		validators = append(
-			validators,
-			p.keyProduction(value),
-		)
+	c := compiler{program: &Program{selector: selector, logger: settings.log.logger}, consts: make(map[interface{}]int32)}
+	if _, err := c.selectorProduction(tokens); err != nil {
+		return nil, err
 	}
-	_, matched, _ = p.peek(tokens, S_PCLASS)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_PCLASS)
-		validators = append(
-			validators,
-			p.pclassProduction(value),
-		)
+	for _, code := range c.selectors {
+		c.program.code = append(c.program.code, code...)
 	}
-	_, matched, _ = p.peek(tokens, S_NTH_FUNC)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_NTH_FUNC)
-		validator, tokens = p.nthChildProduction(value, tokens)
-		validators = append(validators, validator)
+	if err := c.program.link(); err != nil {
+		return nil, err
 	}
-	_, matched, _ = p.peek(tokens, S_PCLASS_FUNC)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_PCLASS_FUNC)
-		validator, tokens = p.pclassFuncProduction(value, tokens, documentMap)
-		validators = append(validators, validator)
+	return c.program, nil
+}
+
+// constant returns the index of value among the program's constants.
+func (c *compiler) constant(value interface{}) int32 {
+	if i, ok := c.consts[value]; ok {
+		return i
 	}
-	result, matched, _ := p.peek(tokens, S_OPER)
-	if matched && result.(string) == "*" {
-		value, tokens, _ = p.match(tokens, S_OPER)
-		validator = p.universalProduction(value)
-		validators = append(validators, validator)
+	i := int32(len(c.program.consts))
+	c.program.consts = append(c.program.consts, value)
+	c.consts[value] = i
+	return i
+}
+
+// regexFlags lists the flags a regular expression literal may end with,
+// which RE2 applies to the whole pattern.
+const regexFlags = "ims"
+
+// regex compiles the regular expression of a regex literal, or of a string
+// holding just its pattern, returning the index of the constant it is
+// stored as.
+func (c *compiler) regex(t *token) (int32, error) {
+	pattern := t.val.(string)
+	source := strconv.Quote(pattern)
+	if t.typ == S_REGEX {
+		source = pattern
+		end := strings.LastIndexByte(pattern, '/')
+		flags := pattern[end+1:]
+		for _, flag := range flags {
+			if !strings.ContainsRune(regexFlags, flag) {
+				return 0, errors.New(fmt.Sprintf("Unknown flag %q in regular expression %s at column %d", flag, source, t.column))
+			}
+		}
+		pattern = pattern[1:end]
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
 	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid regular expression %s at column %d: %s", source, t.column, strings.TrimPrefix(err.Error(), "error parsing regexp: ")))
+	}
+	i := c.constant(pattern)
+	if c.program.regexps == nil {
+		c.program.regexps = make(map[int32]*regexp.Regexp)
+	}
+	c.program.regexps[i] = re
+	return i, nil
+}
 
-	if len(validators) < 1 {
-		return nil, errors.New("No selector recognized")
+// selectorProduction compiles the compound selectors and combinators of
+// tokens as a new selector of the program, returning its index.  The
+// validators of each compound are ordered so that the cheapest are
+// applied first.
+func (c *compiler) selectorProduction(tokens []*token) (int32, error) {
+	index := int32(len(c.selectors))
+	c.selectors = append(c.selectors, nil)
+
+	var code []instruction
+	for {
+		validators, rest, err := c.compoundProduction(tokens)
+		if err != nil {
+			// Forget the arguments of any `:has` compiled so far.
+			c.selectors = c.selectors[:index]
+			return 0, err
+		}
+		tokens = rest
+
+		code = append(code, c.stepCode(validators)...)
+
+		var operator string
+		value, matched, _ := peek(tokens, S_OPER)
+		if matched {
+			_, tokens, _ = match(tokens, S_OPER)
+			operator = value.(string)
+			if _, ok := joinOpcodes[operator]; !ok || operator == "" {
+				c.selectors = c.selectors[:index]
+				return 0, errors.New("Unrecognized operator")
+			}
+		} else if len(tokens) > 0 {
+			operator = " "
+		}
+		code = append(code, instruction{op: joinOpcodes[operator]})
+		if operator == "" {
+			break
+		}
 	}
+	c.selectors[index] = code
+	return index, nil
+}
 
-	results, err := p.matchNodes(validators, documentMap)
+// stepCode returns the STEP and VALIDATOR instructions of a compound
+// selector made of validators.
+func (c *compiler) stepCode(validators []compiledValidator) []instruction {
+	var compound string
+	for _, validator := range validators {
+		compound += validator.name
+	}
+	code := []instruction{{op: OP_STEP, a: c.constant(compound)}}
+	sort.SliceStable(validators, func(i, j int) bool {
+		return validatorCost(validators[i].validator) < validatorCost(validators[j].validator)
+	})
+	for _, validator := range validators {
+		var kind int32
+		for i, k := range validatorKinds {
+			if k == validator.kind {
+				kind = int32(i)
+			}
+		}
+		code = append(code, instruction{op: OP_VALIDATOR, a: c.constant(validator.name), b: kind})
+		code = append(code, validator.code...)
+	}
+	return code
+}
+
+// compoundProduction consumes the tokens of a single compound selector,
+// such as `object.beers:first-child`, returning a validator for each of
+// its components along with the remaining tokens.
+//
+// `:parent` turns the compound so far into the set of its matches'
+// parents, which the components following it are applied to: `.sku:parent`
+// is the object holding `.sku`, and `.sku:parent(2)` or
+// `.sku:parent:parent` the one above.
+func (c *compiler) compoundProduction(tokens []*token) ([]compiledValidator, []*token, error) {
+	// The selectors of the compound's arguments start here.
+	start := int32(len(c.selectors))
+	validators, tokens, err := c.componentsProduction(tokens)
 	if err != nil {
-		return nil, err
+		return nil, tokens, err
 	}
-	logger.Print("Applying ", len(validators), " validators to document resulted in ", len(results), " matches")
+	for {
+		_, matched, _ := peek(tokens, S_PARENT)
+		if !matched {
+			break
+		}
+		if len(validators) == 0 {
+			// A compound cannot start with `:parent`, which would select the
+			// parents of every node; `.a :parent` is `.a *:parent`.
+			return nil, tokens, errors.New(fmt.Sprintf("Unexpected :parent at column %d: it must be attached to the selector whose parents it matches, as in .sku:parent, or to * for any node", tokens[0].column))
+		}
 
-	_, matched, _ = p.peek(tokens, S_OPER)
-	if matched {
-		value, tokens, _ = p.match(tokens, S_OPER)
-		logger.Print("Recursing selectorProduction(", recursionDepth, ") via operator ", value, " starting with ", tokens[0], " ;", len(tokens), " tokens remaining")
-		logger.IncreaseDepth()
-		rvals, err := p.selectorProduction(tokens, documentMap, recursionDepth+1)
-		logger.DecreaseDepth()
-		logger.Print("Recursion completed; returned control to selectorProduction(", recursionDepth, ") via operator ", value, " with ", len(rvals), " matches.")
-		if err != nil {
-			return nil, err
-		}
-		switch value {
-		case ",":
-			logger.Print("(", recursionDepth, ") Operator ',': ", len(results), " => ", len(results)+len(rvals))
-			for _, val := range rvals {
-				// TODO: This is quite slow
-				// it seems like it's probably quite easy to expand
-				// the list just once
-				results = append(results, val)
+		name := ""
+		for _, validator := range validators {
+			name += validator.name
+		}
+		var levels int32
+		for {
+			_, matched, _ = peek(tokens, S_PARENT)
+			if !matched {
+				break
 			}
-		case ">":
-			originalLength := len(results)
-			results = parents(results, rvals)
-			logger.Print("(", recursionDepth, ") Operator '>': ", originalLength, " => ", len(results))
-		case "~":
-			originalLength := len(results)
-			results = siblings(results, rvals)
-			logger.Print("(", recursionDepth, ") Operator '~': ", originalLength, " => ", len(results))
-		case " ":
-			originalLength := len(results)
-			results = ancestors(results, rvals)
-			logger.Print("(", recursionDepth, ") Operator ' ': ", originalLength, " => ", len(results))
-		default:
-			return nil, errors.New("Unrecognized operator")
-		}
-	} else if len(tokens) > 0 {
-		logger.Print("Recursing selectorProduction(", recursionDepth, ") for excess tokens starting with ", tokens[0], " ;", len(tokens), " tokens remaining")
-		logger.IncreaseDepth()
-		rvals, err := p.selectorProduction(tokens, documentMap, recursionDepth+1)
-		logger.DecreaseDepth()
-		logger.Print("Recursion completed; returned control to selectorProduction(", recursionDepth, ") for excess tokens with ", len(rvals), " matches.")
+			tokens = tokens[1:]
+			name += ":parent"
+			n := int32(1)
+			if _, matched, _ = peek(tokens, S_EXPR); matched {
+				arg := tokens[0]
+				tokens = tokens[1:]
+				text := arg.val.(string)
+				parsed, err := strconv.ParseInt(strings.TrimSpace(text[1:len(text)-1]), 10, 32)
+				if err != nil || parsed < 1 {
+					return nil, tokens, errors.New(fmt.Sprintf("Invalid argument %s to :parent at column %d: expected a positive number of levels", text, arg.column))
+				}
+				name += text
+				n = int32(parsed)
+			}
+			levels += n
+		}
+
+		// The components so far refer to the selectors from start on, which
+		// must follow the one they now belong to.
+		c.insertSelector(start, append(c.stepCode(validators), instruction{op: OP_END}))
+		parent := compiledValidator{validator{name: name, kind: S_PARENT}, []instruction{{op: OP_PARENT, a: start, b: levels}}}
+
+		validators, tokens, err = c.componentsProduction(tokens)
 		if err != nil {
-			return nil, err
+			return nil, tokens, err
 		}
-		results = ancestors(results, rvals)
+		validators = append([]compiledValidator{parent}, validators...)
 	}
 
-	logger.Print("selectorProduction(", recursionDepth, ") returning ", len(results), " matches.")
-	return results, nil
+	if len(validators) < 1 {
+		return nil, tokens, errors.New("No selector recognized")
+	}
+	return validators, tokens, nil
+}
+
+// scopeCombinator returns the combinator joining the `:scope` a selector
+// starts with to the rest of it, or OP_END if the selector is not anchored
+// at `:scope` alone.  A union is only anchored by `~` or `+`, which every
+// alternative then follows, since `>` and ` ` would have to be chained
+// through each alternative.
+func (c *compiler) scopeCombinator(code []instruction) opcode {
+	if code[0].op != OP_STEP || c.program.consts[code[0].a] != ":scope" {
+		return OP_END
+	}
+	for i, in := range code {
+		switch in.op {
+		case OP_SIBLING, OP_ADJACENT, OP_END:
+			return in.op
+		case OP_UNION:
+			return OP_END
+		case OP_DESCENDANT, OP_CHILD:
+			for _, rest := range code[i+1:] {
+				if rest.op == OP_UNION {
+					return OP_END
+				}
+			}
+			return in.op
+		}
+	}
+	return OP_END
+}
+
+// insertSelector inserts code as selector index of the program, renumbering
+// the references to the selectors it displaces.
+func (c *compiler) insertSelector(index int32, code []instruction) {
+	c.selectors = append(c.selectors, nil)
+	copy(c.selectors[index+1:], c.selectors[index:])
+	c.selectors[index] = code
+	for _, selector := range c.selectors[index:] {
+		for i, in := range selector {
+			switch in.op {
+			case OP_HAS, OP_NOT, OP_IS, OP_PARENT:
+				if in.a >= index {
+					selector[i].a++
+				}
+			}
+		}
+	}
+}
+
+// componentsProduction consumes the type, key, pseudo-classes and `*` a
+// compound selector may have, in that order.
+func (c *compiler) componentsProduction(tokens []*token) ([]compiledValidator, []*token, error) {
+	var matched bool
+	var value interface{}
+	var code []instruction
+	var err error
+	var validators = make([]compiledValidator, 0, 10)
+	add := func(name string, kind tokenType, code []instruction) {
+		validators = append(validators, compiledValidator{validator{name: name, kind: kind}, code})
+	}
+
+	_, matched, _ = peek(tokens, S_TYPE)
+	if matched {
+		value, tokens, _ = match(tokens, S_TYPE)
+		add(value.(string), S_TYPE, c.typeProduction(value))
+	}
+	_, matched, _ = peek(tokens, S_IDENTIFIER)
+	if matched {
+		value, tokens, _ = match(tokens, S_IDENTIFIER)
+		add("."+value.(string), S_IDENTIFIER, c.keyProduction(value))
+	} else if _, matched, _ = peek(tokens, S_KEY_PATTERN); matched {
+		value, tokens, _ = match(tokens, S_KEY_PATTERN)
+		re, err := c.keyPattern(keyGlobPattern(value.(string), false))
+		if err != nil {
+			return nil, tokens, err
+		}
+		add("."+value.(string), S_KEY_PATTERN, []instruction{{op: OP_KEY_MATCHES, a: re}})
+	}
+	_, matched, _ = peek(tokens, S_PCLASS)
+	if matched {
+		value, tokens, _ = match(tokens, S_PCLASS)
+		add(":"+value.(string), S_PCLASS, c.pclassProduction(value))
+	}
+	_, matched, _ = peek(tokens, S_NTH_FUNC)
+	if matched {
+		value, tokens, _ = match(tokens, S_NTH_FUNC)
+		name := ":" + value.(string) + getExpressionText(tokens)
+		code, tokens, err = c.nthChildProduction(value, tokens)
+		if err != nil {
+			return nil, tokens, err
+		}
+		add(name, S_NTH_FUNC, code)
+	}
+	_, matched, _ = peek(tokens, S_PCLASS_FUNC)
+	if matched {
+		value, tokens, _ = match(tokens, S_PCLASS_FUNC)
+		name := ":" + value.(string) + getExpressionText(tokens)
+		code, tokens, err = c.pclassFuncProduction(value, tokens)
+		if err != nil {
+			return nil, tokens, err
+		}
+		add(name, S_PCLASS_FUNC, code)
+	}
+	result, matched, _ := peek(tokens, S_OPER)
+	if matched && result.(string) == "*" {
+		_, tokens, _ = match(tokens, S_OPER)
+		add("*", S_OPER, []instruction{{op: OP_ANY}})
+	}
+	return validators, tokens, nil
 }
 
-func (p *Parser) peek(tokens []*token, typ tokenType) (interface{}, bool, error) {
+func peek(tokens []*token, typ tokenType) (interface{}, bool, error) {
 	if len(tokens) < 1 {
 		return nil, false, errors.New("No more tokens")
 	}
@@ -206,8 +509,8 @@ func (p *Parser) peek(tokens []*token, typ tokenType) (interface{}, bool, error)
 	return nil, false, nil
 }
 
-func (p *Parser) match(tokens []*token, typ tokenType) (interface{}, []*token, error) {
-	value, matched, _ := p.peek(tokens, typ)
+func match(tokens []*token, typ tokenType) (interface{}, []*token, error) {
+	value, matched, _ := peek(tokens, typ)
 	if !matched {
 		return nil, tokens, errors.New("Match not successful")
 	}
@@ -215,286 +518,327 @@ func (p *Parser) match(tokens []*token, typ tokenType) (interface{}, []*token, e
 	return value, tokens, nil
 }
 
-func (p *Parser) matchNodes(validators []func(*jsonNode) bool, documentMap []*jsonNode) ([]*jsonNode, error) {
-	var matches []*jsonNode
-	nodeCount := 0
-	if logger.Enabled {
-		nodeCount = len(documentMap)
-	}
-	for idx, node := range documentMap {
-		var passed = true
-		if logger.Enabled {
-			logger.SetPrefix("[Node ", idx, "/", nodeCount, "] ")
-		}
-		for _, validator := range validators {
-			if !validator(node) {
-				passed = false
-				break
-			}
-		}
-		if passed {
-			logger.Print("MATCHED: ", node)
-			matches = append(matches, node)
-		}
-	}
-	return matches, nil
+// fail returns the code of a validator rejecting every node, used when a
+// selector component could not be understood.
+func (c *compiler) fail(reason string) []instruction {
+	return []instruction{{op: OP_FAIL, a: c.constant(reason)}}
 }
 
-func (p *Parser) typeProduction(value interface{}) func(*jsonNode) bool {
-	logger.Print("Creating typeProduction validator ", value)
-	return func(node *jsonNode) bool {
-		logger.Print("typeProduction ? ", node.typ, " == ", value)
-		return string(node.typ) == value
-	}
+func (c *compiler) typeProduction(value interface{}) []instruction {
+	return []instruction{{op: OP_TYPE, a: int32(getJsonType(value.(string)))}}
 }
 
-func (p *Parser) keyProduction(value interface{}) func(*jsonNode) bool {
-	logger.Print("Creating keyProduction validator ", value)
-	return func(node *jsonNode) bool {
-		logger.Print("keyProduction ? ", node.parent_key, " == ", value)
-		if node.parent_key == "" {
-			return false
+func (c *compiler) keyProduction(value interface{}) []instruction {
+	return []instruction{{op: OP_KEY, a: c.constant(value)}}
+}
+
+// keyGlobPattern returns a regular expression matching the keys that glob
+// does, `*` standing for any run of characters and `?` for any single one
+// unless escaped by a backslash.
+func keyGlobPattern(glob string, insensitive bool) string {
+	var pattern strings.Builder
+	if insensitive {
+		pattern.WriteString("(?i)")
+	}
+	pattern.WriteString(`(?s)^`)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*':
+			pattern.WriteString(".*")
+		case c == '?':
+			pattern.WriteString(".")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
 		}
-		return string(node.parent_key) == value
 	}
+	pattern.WriteString("$")
+	return pattern.String()
 }
 
-func (p *Parser) universalProduction(value interface{}) func(*jsonNode) bool {
-	operator := value.(string)
-	if operator == "*" {
-		return func(node *jsonNode) bool {
-			logger.Print("universalProduction ? true")
-			return true
-		}
-	} else {
-		logger.Print("Error: Unexpected operator: ", operator)
-		return func(node *jsonNode) bool {
-			logger.Print("Asserting false due to failed universalProduction")
-			return false
-		}
+// keyPattern returns the index of the constant holding pattern, a regular
+// expression built from a key, compiling it.
+func (c *compiler) keyPattern(pattern string) (int32, error) {
+	return c.regex(&token{typ: S_STRING, val: pattern})
+}
+
+var pclassOpcodes = map[string]opcode{
+	"first-child": OP_FIRST_CHILD,
+	"last-child":  OP_LAST_CHILD,
+	"only-child":  OP_ONLY_CHILD,
+	"root":        OP_ROOT,
+	"empty":       OP_EMPTY,
+	"scope":       OP_SCOPE,
+}
+
+func (c *compiler) pclassProduction(value interface{}) []instruction {
+	op, ok := pclassOpcodes[value.(string)]
+	if !ok {
+		return c.fail("unknown pclass " + value.(string))
 	}
+	return []instruction{{op: op}}
 }
 
-func (p *Parser) pclassProduction(value interface{}) func(*jsonNode) bool {
+func (c *compiler) nthChildProduction(value interface{}, tokens []*token) ([]instruction, []*token, error) {
 	pclass := value.(string)
-	logger.Print("Creating pclassProduction validator ", pclass)
-	if pclass == "first-child" {
-		return func(node *jsonNode) bool {
-			logger.Print("pclassProduction first-child ? ", node.idx, " == 1")
-			return node.idx == 1
-		}
-	} else if pclass == "last-child" {
-		return func(node *jsonNode) bool {
-			logger.Print("pclassProduction last-child ? ", node.siblings, " > 0 AND ", node.idx, " == ", node.siblings)
-			return node.siblings > 0 && node.idx == node.siblings
-		}
-	} else if pclass == "only-child" {
-		return func(node *jsonNode) bool {
-			logger.Print("pclassProduction ony-child ? ", node.siblings, " == 1")
-			return node.siblings == 1
-		}
-	} else if pclass == "root" {
-		return func(node *jsonNode) bool {
-			logger.Print("pclassProduction root ? ", node.parent, " == nil")
-			return node.parent == nil
-		}
-	} else if pclass == "empty" {
-		return func(node *jsonNode) bool {
-			logger.Print("pclassProduction empty ? ", node.typ, " == ", J_ARRAY, " AND ", len(node.value.(string)), " < 1")
-			return node.typ == J_ARRAY && len(node.value.(string)) < 1
-		}
-	}
-	logger.Print("Error: Unknown pclass: ", pclass)
-	return func(node *jsonNode) bool {
-		logger.Print("Asserting false due to failed pclassProduction")
-		return false
-	}
-}
-
-func (p *Parser) nthChildProduction(value interface{}, tokens []*token) (func(*jsonNode) bool, []*token) {
-	nthChildRegexp := regexp.MustCompile(`^\s*\(\s*(?:([+\-]?)([0-9]*)n\s*(?:([+\-])\s*([0-9]))?|(odd|even)|([+\-]?[0-9]+))\s*\)`)
-	args, tokens, _ := p.match(tokens, S_EXPR)
-	var a int
-	var b int
-	var reverse bool = false
-
-	pattern := nthChildRegexp.FindStringSubmatch(args.(string))
-
-	logger.Print("Creating nthChildProduction validator ", pattern)
-	if logger.Enabled {
-		for idx, pat := range pattern {
-			logger.Print("[", idx, "] ", pat)
-		}
-	}
-
-	if pattern[5] != "" {
-		a = 2
-		if pattern[5] == "odd" {
-			b = 1
-		} else {
-			b = 0
-		}
-	} else if pattern[6] != "" {
-		a = 0
-		b_parsed, _ := strconv.ParseInt(pattern[6], 10, 64)
-		b = int(b_parsed)
-	} else {
-		// Expression like +n-3
-		sign := "+"
-		if pattern[1] != "" {
-			sign = pattern[1]
-		}
-		coeff := "1"
-		if pattern[2] != "" {
-			coeff = pattern[2]
-		}
-		a_parsed, _ := strconv.ParseInt(coeff, 10, 64)
-		a = int(a_parsed)
-		if sign == "-" {
-			a = -1 * a
-		}
-
-		if pattern[3] != "" {
-			b_sign := pattern[3]
-			b_parsed, _ := strconv.ParseInt(pattern[4], 10, 64)
-			b = int(b_parsed)
-			if b_sign == "-" {
-				b = -1 * b
-			}
-		} else {
-			b = 0
-		}
+	_, matched, _ := peek(tokens, S_EXPR)
+	if !matched {
+		return nil, tokens, errors.New(fmt.Sprintf("Missing argument to :%s", pclass))
 	}
+	arg := tokens[0]
+	tokens = tokens[1:]
 
-	if value.(string) == "nth-last-child" {
-		reverse = true
+	text := arg.val.(string)
+	a, b, err := parseNth(text[1 : len(text)-1])
+	if err != nil {
+		return nil, tokens, errors.New(fmt.Sprintf("Invalid argument %s to :%s at column %d: %s", text, pclass, arg.column, err))
 	}
 
-	return func(node *jsonNode) bool {
-		var b_str string
-		if b > 0 {
-			b_str = "+"
-		} else {
-			b_str = "-"
-		}
-		logger.Print("nthChildProduction ", a, "n", b_str, b)
-		logger.Print("nthChildProduction ? ", node.siblings, " == 0")
-		if node.siblings == 0 {
-			return false
+	op := OP_NTH_CHILD
+	if pclass == "nth-last-child" {
+		op = OP_NTH_LAST_CHILD
+	}
+	return []instruction{{op: op, a: a, b: b}}, tokens, nil
+}
+
+// parseNth parses the argument of `:nth-child` and `:nth-last-child`,
+// following the An+B microsyntax of CSS: `odd`, `even`, an integer such as
+// `-3`, or a multiple of n with an optional offset such as `-n+3` or
+// `2n - 1`.
+func parseNth(arg string) (int32, int32, error) {
+	s := strings.ToLower(strings.Trim(arg, " \t\n\r\f"))
+	switch s {
+	case "odd":
+		return 2, 1, nil
+	case "even":
+		return 2, 0, nil
+	}
+
+	// The sign of A, or of B if there is no n, must touch what it applies to.
+	i := 0
+	sign := int64(1)
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		if s[i] == '-' {
+			sign = -1
 		}
+		i++
+	}
+	digits := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	coefficient := s[digits:i]
 
-		idx := node.idx - 1
-		if reverse {
-			idx = node.siblings - idx
-		} else {
-			idx++
+	if i == len(s) || s[i] != 'n' {
+		if coefficient == "" || i != len(s) {
+			return 0, 0, errors.New("expected an integer, odd, even or An+B")
 		}
+		b, err := parseNthInteger(coefficient, sign)
+		return 0, b, err
+	}
 
-		logger.Print("nthChildProduction (continued-1) ? ", a, " == 0")
-		if a == 0 {
-			return b == idx
-		} else {
-			logger.Print("nthChildProduction (continued-2) ? ", idx-b%a, " == 0 AND ", idx*a+b, " >= 0")
-			return ((idx-b)%a) == 0 && (idx*a+b) >= 0
+	a := int32(sign)
+	if coefficient != "" {
+		var err error
+		if a, err = parseNthInteger(coefficient, sign); err != nil {
+			return 0, 0, err
 		}
-	}, tokens
-}
+	}
+	for i++; i < len(s) && isSpace(s[i]); i++ {
+	}
+	if i == len(s) {
+		return a, 0, nil
+	}
 
-func (p *Parser) pclassFuncProduction(value interface{}, tokens []*token, documentMap []*jsonNode) (func(*jsonNode) bool, []*token) {
-	sargs, tokens, _ := p.match(tokens, S_EXPR)
-	pclass := value.(string)
+	// B's sign may be surrounded by whitespace, but B itself is unsigned.
+	sign = 1
+	switch s[i] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, 0, errors.New("expected + or - after n")
+	}
+	for i++; i < len(s) && isSpace(s[i]); i++ {
+	}
+	digits = i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if digits == i || i != len(s) {
+		return 0, 0, errors.New("expected an unsigned integer offset")
+	}
+	b, err := parseNthInteger(s[digits:i], sign)
+	return a, b, err
+}
 
-	logger.Print("Creating pclassFuncProduction validator ", pclass)
+func parseNthInteger(digits string, sign int64) (int32, error) {
+	value, err := strconv.ParseInt(digits, 10, 32)
+	if err != nil {
+		return 0, errors.New(digits + " is out of range")
+	}
+	return int32(sign * value), nil
+}
 
-	logme := func(lexString string, args []*token) {
-		logger.Print("pclassFuncProduction lex results for [", lexString, "]: (follow)")
-		if logger.Enabled {
-			for i, arg := range args {
-				logger.Print("[", i, "]: ", arg)
-			}
-		}
+func (c *compiler) pclassFuncProduction(value interface{}, tokens []*token) ([]instruction, []*token, error) {
+	_, matched, _ := peek(tokens, S_EXPR)
+	if !matched {
+		return c.fail("missing argument"), tokens, nil
 	}
+	arg := tokens[0]
+	sargs, tokens, _ := match(tokens, S_EXPR)
+	pclass := value.(string)
+	// The argument without its parentheses.
+	lexString := sargs.(string)[1 : len(sargs.(string))-1]
 
 	switch pclass {
 	case "expr":
-		tokens, err := lex(sargs.(string), expressionScanner)
+		args, err := lexAt(sargs.(string), expressionScanner, arg.pos, arg.column)
+		if err != nil {
+			return nil, tokens, err
+		}
+		code, err := c.expressionProduction(args)
 		if err != nil {
-			panic(err)
+			return nil, tokens, err
 		}
-		logme(sargs.(string), tokens)
-		var tokens_to_return []*token
-		return func(node *jsonNode) bool {
-			result := p.parseExpression(tokens, node)
-			logger.Print("pclassFuncProduction expr ? ", result)
-			return exprElementIsTruthy(result)
-		}, tokens_to_return
+		code = append([]instruction{{op: OP_EXPR}}, code...)
+		return append(code, instruction{op: OP_TRUTHY}), tokens, nil
 
 	case "has":
-		lexString := sargs.(string)[1 : len(sargs.(string))-1]
-		args, _ := lex(lexString, selectorScanner)
-		logme(lexString, args)
-
-		return func(node *jsonNode) bool {
-			newMap := p.getFlooredDocumentMap(node)
-			if len(args) > 0 {
-				logger.Print("pclassFuncProduction recursing into selectorProduction(-100) starting with ", args[0], "; ", len(args), " tokens remaining.")
-			}
-			logger.IncreaseDepth()
-			rvals, _ := p.selectorProduction(args, newMap, -100)
-			logger.DecreaseDepth()
-			logger.Print("pclassFuncProduction resursion completed with ", len(rvals), " results.")
-			ancestors := make(map[*simplejson.Json]*jsonNode, len(rvals))
-			for _, node := range rvals {
-				if node.parent != nil {
-					ancestors[node.parent.json] = node.parent
-				}
-			}
-			logger.Print("pclassFuncProduction has ? ", node, " ∈ ", getFormattedNodeMap(ancestors))
-			return nodeIsMemberOfHaystack(node, ancestors)
-		}, tokens
+		args, _ := lexAt(lexString, selectorScanner, arg.pos+1, arg.column+1)
+		// A relative selector, starting with a combinator, is relative to
+		// the node itself, which `:scope` matches.
+		if len(args) > 0 && args[0].typ == S_OPER && strings.Contains(">~+", args[0].val.(string)) {
+			scope := &token{typ: S_PCLASS, val: "scope", pos: args[0].pos, column: args[0].column}
+			args = append([]*token{scope}, args...)
+		}
+		selector, err := c.selectorProduction(args)
+		if err != nil {
+			return c.fail(err.Error()), tokens, nil
+		}
+		// Nodes preceded by the node itself can only be found among its
+		// following siblings, and nodes below it among all its descendants
+		// rather than just its children.
+		var axis int32
+		switch c.scopeCombinator(c.selectors[selector]) {
+		case OP_SIBLING, OP_ADJACENT:
+			axis = hasFollowingSiblings
+		case OP_CHILD, OP_DESCENDANT:
+			axis = hasDescendants
+		}
+		return []instruction{{op: OP_HAS, a: selector, b: axis}}, tokens, nil
+
+	case "not", "is", "where":
+		// Unlike `:has`, a bad argument is an error: failing would turn a
+		// negation into a filter that accepts everything.
+		args, err := lexAt(lexString, selectorScanner, arg.pos+1, arg.column+1)
+		if err != nil {
+			return nil, tokens, err
+		}
+		if len(args) == 0 {
+			return nil, tokens, errors.New(fmt.Sprintf("Missing argument to :%s at column %d", pclass, arg.column))
+		}
+		selector, err := c.selectorProduction(args)
+		if err != nil {
+			return nil, tokens, err
+		}
+		if pclass == "not" {
+			return []instruction{{op: OP_NOT, a: selector}}, tokens, nil
+		}
+		// `:where` is `:is` under the name CSS gives it for rules that should
+		// not add specificity, which JSONSelect has no notion of.
+		return []instruction{{op: OP_IS, a: selector}}, tokens, nil
 
 	case "contains":
-		lexString := sargs.(string)[1 : len(sargs.(string))-1]
-		args, _ := lex(lexString, selectorScanner)
-		logme(lexString, args)
+		args, _ := lexAt(lexString, selectorScanner, arg.pos+1, arg.column+1)
+		if len(args) < 1 {
+			return c.fail("contains must have an argument"), tokens, nil
+		}
+		substring, ok := args[0].val.(string)
+		if !ok {
+			return c.fail("invalid argument"), tokens, nil
+		}
+		return []instruction{{op: OP_CONTAINS, a: c.constant(substring)}}, tokens, nil
 
-		return func(node *jsonNode) bool {
-			logger.Print("pclassFuncProduction contains ? ", node.typ, " == ", J_STRING, " AND ", strings.Count(node.value.(string), args[0].val.(string)), " > 0")
-			return node.typ == J_STRING && strings.Count(node.value.(string), args[0].val.(string)) > 0
-		}, tokens
+	case "matches":
+		args, err := lexAt(lexString, expressionScanner, arg.pos+1, arg.column+1)
+		if err != nil {
+			return nil, tokens, err
+		}
+		if len(args) != 1 || args[0].typ != S_REGEX {
+			return nil, tokens, errors.New(fmt.Sprintf("Invalid argument to :matches at column %d: expected a regular expression such as /^a/i", arg.column))
+		}
+		re, err := c.regex(args[0])
+		if err != nil {
+			return nil, tokens, err
+		}
+		return []instruction{{op: OP_MATCHES, a: re}}, tokens, nil
+
+	case "key":
+		// The argument is a regular expression, or a key or a glob like
+		// those following a `.`, optionally followed by the flag `i` for
+		// case-insensitive matching.
+		leading := len(lexString) - len(strings.TrimLeft(lexString, " \t\n\r\f"))
+		argument := strings.TrimSpace(lexString)
+		invalid := errors.New(fmt.Sprintf("Invalid argument to :key at column %d: expected a key, a glob or a regular expression", arg.column))
+		if strings.HasPrefix(argument, "/") {
+			args, err := lexAt(lexString, expressionScanner, arg.pos+1, arg.column+1)
+			if err != nil {
+				return nil, tokens, err
+			}
+			if len(args) != 1 || args[0].typ != S_REGEX {
+				return nil, tokens, invalid
+			}
+			re, err := c.regex(args[0])
+			if err != nil {
+				return nil, tokens, err
+			}
+			return []instruction{{op: OP_KEY_MATCHES, a: re}}, tokens, nil
+		}
+		var insensitive bool
+		if unflagged := strings.TrimRight(strings.TrimSuffix(argument, "i"), " \t\n\r\f"); len(unflagged) < len(argument)-1 {
+			argument, insensitive = unflagged, true
+		}
+		// The argument stands where the key of a selector would, just
+		// after a `.` placed over the parenthesis or space before it.
+		args, err := lexAt("."+argument, selectorScanner, arg.pos+leading, arg.column+leading)
+		if err != nil {
+			return nil, tokens, err
+		}
+		if len(args) != 1 {
+			return nil, tokens, invalid
+		}
+		var pattern string
+		switch {
+		case args[0].typ == S_KEY_PATTERN:
+			pattern = keyGlobPattern(args[0].val.(string), insensitive)
+		case args[0].typ == S_IDENTIFIER && insensitive:
+			pattern = `(?i)(?s)^` + regexp.QuoteMeta(args[0].val.(string)) + "$"
+		case args[0].typ == S_IDENTIFIER:
+			return c.keyProduction(args[0].val), tokens, nil
+		default:
+			return nil, tokens, invalid
+		}
+		re, err := c.keyPattern(pattern)
+		if err != nil {
+			return nil, tokens, err
+		}
+		return []instruction{{op: OP_KEY_MATCHES, a: re}}, tokens, nil
 
 	case "val":
-		lexString := sargs.(string)[1 : len(sargs.(string))-1]
-		args, _ := lex(lexString, expressionScanner)
-		logme(lexString, args)
+		args, _ := lexAt(lexString, expressionScanner, arg.pos+1, arg.column+1)
 		if len(args) != 1 {
-			logger.Print("Error: val must have one argument, not ", len(args))
-			return func(node *jsonNode) bool {
-				logger.Print("Asserting false due to failed pclassFuncProduction")
-				return false
-			}, tokens
+			return c.fail("val must have exactly one argument"), tokens, nil
 		}
 		if args[0].typ == S_PAREN || args[0].typ == S_EMPTY || args[0].typ == S_BINOP {
-			logger.Print("Error: val has invalid argument ", args[0].typ)
-			return func(node *jsonNode) bool {
-				logger.Print("Asserting false due to failed pclassFuncProduction")
-				return false
-			}, tokens
+			return c.fail("invalid argument"), tokens, nil
 		}
-
-		return func(node *jsonNode) bool {
-			lhsString := getJsonString(node.value)
-			rhsString := getJsonString(args[0].val)
-			logger.Print("pclassFuncProduction val ? ", lhsString, " == ", rhsString)
-			return lhsString == rhsString
-		}, tokens
+		return []instruction{{op: OP_VAL, a: c.constant(getJsonString(args[0].val))}}, tokens, nil
 
 	default:
 		// If we didn't find a known pclass, do not match anything.
-		logger.Print("Error: Unknown pclass: ", pclass)
-		return func(node *jsonNode) bool {
-			logger.Print("Asserting false due to failed pclassFuncProduction")
-			return false
-		}, tokens
+		return c.fail("unknown pclass " + pclass), tokens, nil
 	}
 }
@@ -1,10 +1,18 @@
 package jsonselect
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/coddingtonbear/go-simplejson"
 	"io/ioutil"
+	"log/slog"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -216,6 +224,1130 @@ func TestExtra(t *testing.T) {
 	runTestsInDirectory(t, "./test_data/extra/")
 }
 
+func TestWithLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	parser, err := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}]}`,
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.GetValues(".rating"); err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal("Trace record is not structured: ", line)
+		}
+		if record["validator"] == ".rating" && record["node"] == "/beers/0/rating" {
+			found = true
+			if record["matched"] != true {
+				t.Error("Expected /beers/0/rating to be recorded as matched: ", line)
+			}
+		}
+	}
+	if !found {
+		t.Error("No .rating record found for /beers/0/rating in ", buffer.String())
+	}
+
+	// A program compiled with a logger of its own traces to that logger.
+	var programBuffer bytes.Buffer
+	program, err := Compile(".title", WithLogger(slog.New(slog.NewJSONHandler(&programBuffer, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Reset()
+	if _, err := parser.GetCompiledValues(program); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(programBuffer.String(), `"validator":".title"`) || buffer.Len() != 0 {
+		t.Error("Expected the program's trace events in its own logger; got ", programBuffer.String(), " and ", buffer.String())
+	}
+}
+
+// TestConcurrentQueries evaluates selectors on a single parser from
+// several goroutines at once; run it with -race.
+func TestConcurrentQueries(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50, "tags": ["pale"]}, {"title": "beta", "rating": 80}], "brewery": {"title": "gamma"}}`,
+		WithLogger(slog.New(slog.NewJSONHandler(ioutil.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		WithProfiler(NewProfiler()),
+	)
+	selectors := map[string][]string{
+		`object:has(.rating:expr(x > 60)) > .title`: {`"beta"`},
+		`.beers object:not(:has(.tags)) > .title`:   {`"beta"`},
+		`:has(> .tags > string) > .title`:           {`"alpha"`},
+		`.title:expr(len(x) = 5)`:                   {`"alpha"`, `"gamma"`},
+		`.title ~ .rating`:                          {"50", "80"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for selector, expected := range selectors {
+					values, err := parser.GetValues(selector)
+					if err != nil {
+						t.Error(selector, ": ", err)
+					} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+						t.Error(selector, ": expected ", expected, "; got ", encodings)
+					}
+				}
+				if _, err := parser.Explain(".beers .title"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExplain(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}]}`,
+	)
+	trace, err := parser.Explain(".beers object:has(.rating:expr(x>70))")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(trace.Matches, []string{"/beers/1"}) {
+		t.Error("Unexpected matches ", trace.Matches)
+	}
+	if trace.Root.Selector != ".beers" || trace.Root.Matched != 1 {
+		t.Error("Unexpected first step ", *trace.Root)
+	}
+	if trace.Root.Combinator == nil || trace.Root.Combinator.Operator != " " || trace.Root.Combinator.Output != 1 {
+		t.Error("Unexpected combinator ", trace.Root.Combinator)
+	}
+
+	next := trace.Root.Next
+	if next == nil || len(next.Validators) != 2 {
+		t.Fatal("Expected a second step with two validators; got ", next)
+	}
+	object, has := next.Validators[0], next.Validators[1]
+	if object.Name != "object" || object.Kept != 3 || object.Rejected != 5 {
+		t.Error("Unexpected type validator counts ", *object)
+	}
+	if has.Name != ":has(.rating:expr(x>70))" || has.Kept != 1 || has.Rejected != 2 {
+		t.Error("Unexpected :has validator counts ", *has)
+	}
+	if len(has.SubEvaluations) != 3 || has.SubEvaluations[1].Node != "/beers/1" || has.SubEvaluations[1].Match != "/beers/1/rating" {
+		t.Error("Unexpected :has sub-evaluations ", has.SubEvaluations)
+	}
+
+	if _, err := json.Marshal(trace); err != nil {
+		t.Error("Trace could not be serialized: ", err)
+	}
+}
+
+func TestWhyNot(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}], "other": {"ratings": 3, "x": {"rating": 100}}}`,
+	)
+	tests := []struct {
+		selector string
+		pointer  string
+		reason   string
+	}{
+		{".beers object:has(.rating:expr(x>70))", "/beers/1", ""},
+		{".beers object:has(.rating:expr(x>70))", "/beers/0", "no descendant matched `.rating:expr(x>70)`"},
+		{".beers object:has(.rating:expr(x>70))", "/other/x", "no ancestor matched `.beers`"},
+		{".rating", "/other/ratings", "key `ratings` != `rating`"},
+		{".rating:expr(x>70)", "/beers/0/rating", "`:expr(x>70)` evaluated to false with x=50"},
+		{".beers > .rating", "/other/x/rating", "parent \"/other/x\" did not match `.beers`: key `x` != `beers`"},
+		{"object:not(:has(.rating:expr(x>70)))", "/beers/1", "node matched `:has(.rating:expr(x>70))`"},
+		{"object:is(.beers, .x)", "/other", "node matched none of `.beers, .x`"},
+		{".title + .tags", "/beers/0/rating", "key `rating` != `tags`"},
+		{".tags:parent", "/other/x", "node is not among those `.tags:parent` selects"},
+		{".beers > object:has(~ :has(> .rating:expr(x > 80)))", "/beers/1", "no following sibling matched `~ :has(> .rating:expr(x > 80))`"},
+		{".rating + .title", "/beers/0/title", "node has no preceding sibling to match `.rating`"},
+		{".title + .x", "/other/x", "preceding sibling \"/other/ratings\" did not match `.title`: key `ratings` != `title`"},
+		{".x ~ .ratings", "/other/ratings", "no preceding sibling matched `.x`"},
+		{".rat*s", "/other/x/rating", "key `rating` does not match `rat*s`"},
+		{":key(/^b/)", "/beers/0", "node has no key to compare with `:key(/^b/)`"},
+	}
+	for _, test := range tests {
+		report, err := parser.WhyNot(test.selector, test.pointer)
+		if err != nil {
+			t.Error("WhyNot(", test.selector, ", ", test.pointer, ") failed: ", err)
+			continue
+		}
+		if report.Matched != (test.reason == "") || report.Reason != test.reason {
+			t.Error("WhyNot(", test.selector, ", ", test.pointer, ") = ", report, "; expected reason ", test.reason)
+		}
+	}
+
+	if _, err := parser.WhyNot(".rating", "/missing"); err == nil {
+		t.Error("Expected an error for a pointer not present in the document")
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	profiler := NewProfiler()
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}]}`,
+		WithProfiler(profiler),
+	)
+	if _, err := parser.GetValues(".beers object:has(.rating:expr(x>70))"); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds = make(map[string]ProfileEntry)
+	report := profiler.Report()
+	for i, entry := range report.Entries {
+		kinds[entry.Kind+" "+entry.Selector] = entry
+		if i > 0 && entry.SelfTime > report.Entries[i-1].SelfTime {
+			t.Error("Report is not sorted by self time: ", report.Entries)
+		}
+	}
+	for _, expected := range []string{
+		"step .beers",
+		"matchNodes object:has(.rating:expr(x>70))",
+		"probe .beers",
+		"has :has(.rating:expr(x>70))",
+		"expr :expr(x>70)",
+	} {
+		if _, ok := kinds[expected]; !ok {
+			t.Error("No profile entry recorded for ", expected, "; got ", report.Entries)
+		}
+	}
+	if entry := kinds["matchNodes object:has(.rating:expr(x>70))"]; entry.Calls != 1 || entry.Nodes != 8 {
+		t.Error("Unexpected matchNodes entry ", entry)
+	}
+	if entry := kinds["has :has(.rating:expr(x>70))"]; entry.Calls != 3 {
+		t.Error("Expected :has to be evaluated for each of 3 objects; got ", entry)
+	}
+	if entry := kinds["expr :expr(x>70)"]; entry.Calls != 2 || entry.WallTime != 0 {
+		t.Error("Expected :expr to be counted for each of 2 ratings, untimed; got ", entry)
+	}
+
+	if _, err := json.Marshal(report); err != nil {
+		t.Error("Report could not be serialized: ", err)
+	}
+	profiler.Reset()
+	if len(profiler.Report().Entries) != 0 {
+		t.Error("Reset did not discard entries")
+	}
+}
+
+func getSortedEncodings(values []interface{}) []string {
+	var encoded []string
+	for _, value := range values {
+		encodedValue, _ := json.Marshal(value)
+		encoded = append(encoded, string(encodedValue))
+	}
+	sort.Strings(encoded)
+	return encoded
+}
+
+func TestIndexes(t *testing.T) {
+	document := `{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}], "count": 2}`
+	plain, _ := CreateParserFromString(document)
+	indexed, _ := CreateParserFromString(document, WithIndexes())
+
+	for _, selector := range []string{".rating", "number", ":root", "object.beers", ".beers object:has(.rating:expr(x>70))", "string, .count"} {
+		expected, _ := plain.GetValues(selector)
+		actual, err := indexed.GetValues(selector)
+		if err != nil {
+			t.Error("Selector ", selector, " failed: ", err)
+		}
+		// Object members are mapped in map iteration order, so only
+		// compare the sets of values found.
+		if !reflect.DeepEqual(getSortedEncodings(expected), getSortedEncodings(actual)) {
+			t.Error("Indexed results for ", selector, " differ: ", actual, " != ", expected)
+		}
+	}
+
+	trace, _ := indexed.Explain(".rating")
+	if trace.Root.Nodes != 2 {
+		t.Error("Expected the key index to yield 2 candidates; got ", trace.Root.Nodes)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}], "count": 2}`,
+		WithIndexes(),
+	)
+
+	plan, err := parser.Plan(":root .beers object:has(.rating:expr(x>70)) > .title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 4 {
+		t.Fatal("Expected 4 steps; got ", plan)
+	}
+	last := plan.Steps[3]
+	if last.Strategy != StrategyScan || !last.Indexed || last.Candidates != 2 {
+		t.Error("Expected the rightmost step to scan the 2 indexed titles; got ", last)
+	}
+	for _, step := range plan.Steps[:3] {
+		if step.Strategy != StrategyProbe {
+			t.Error("Expected ", step.Selector, " to be probed; got ", step.Strategy)
+		}
+	}
+	if !reflect.DeepEqual(plan.Steps[2].Validators, []string{"object", ":has(.rating:expr(x>70))"}) {
+		t.Error("Expected the cheap validator to be applied first; got ", plan.Steps[2].Validators)
+	}
+
+	trace, err := parser.Explain(":root .beers object:has(.rating:expr(x>70)) > .title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(trace.Matches, []string{"/beers/1/title"}) {
+		t.Error("Unexpected matches ", trace.Matches)
+	}
+	// Only the matching title and its three ancestors are examined.
+	if trace.Root.Strategy != StrategyProbe || trace.Root.Nodes != 4 || trace.Root.Matched != 1 {
+		t.Error("Expected `:root` to be probed against 4 nodes; got ", trace.Root)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"beers": [{"title": "alpha", "rating": 50}, {"title": "beta", "rating": 90}], "count": 2}`,
+	)
+
+	program, err := Compile(`.count:val(2), .beers object:has(.rating:expr(x > 10 * 7)) > .title`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disassembly := program.String()
+	for _, expected := range []string{"HAS 1", "PUSH 10", "PUSH 7", "MUL", "GT", "TRUTHY", "VAL \"2\"", "UNION"} {
+		if !strings.Contains(disassembly, expected) {
+			t.Error("Expected `", expected, "` in the program; got\n", disassembly)
+		}
+	}
+
+	encoded, err := program.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Program
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Selector() != program.Selector() || decoded.String() != disassembly {
+		t.Error("Expected the decoded program to be identical; got\n", decoded.String())
+	}
+	values, err := parser.GetCompiledValues(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(getSortedEncodings(values), []string{`"beta"`, `2`}) {
+		t.Error("Unexpected values ", values)
+	}
+
+	// Truncated or tampered programs are rejected instead of misbehaving.
+	for i := range encoded {
+		if err := decoded.UnmarshalBinary(encoded[:i]); err == nil {
+			t.Error("Expected a program truncated to ", i, " bytes to be rejected")
+		}
+	}
+	tampered := append([]byte{}, encoded...)
+	tampered[len(tampered)-3] = byte(OP_TRUTHY)
+	if err := decoded.UnmarshalBinary(tampered); err == nil {
+		t.Error("Expected a program missing its END to be rejected")
+	}
+
+	for _, selector := range []string{`.a:expr(x >)`, `.a:expr((x > 1)`, `.a:expr(x 1)`, `.a:expr(x % 0 = 1)`, `.a:expr(x % 0.5 = 1)`} {
+		if _, err := Compile(selector); err == nil {
+			t.Error("Expected `", selector, "` to be rejected")
+		}
+	}
+
+	// A divisor only known when running the program cannot make it fail.
+	zeros, _ := CreateParserFromString(`{"a": 0, "b": [7, 0]}`)
+	for selector, expected := range map[string][]string{
+		`:expr(5 % x = null)`:    {"0", "0"},
+		`.b > *:expr(x % 2)`:     {"7"},
+		`.b > *:expr(7 % x > 0)`: nil,
+	} {
+		values, err := zeros.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+}
+
+func TestLex(t *testing.T) {
+	tokens, err := lex(`.é > :has(:contains(")")) , .b:expr(x-1 > 2)`, selectorScanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lexed []string
+	for _, token := range tokens {
+		lexed = append(lexed, fmt.Sprintf("%s %v %d:%d", token.typ, token.val, token.pos, token.column))
+	}
+	expected := []string{
+		"identifier é 0:1",
+		"operator > 4:4",
+		"pclass_func has 6:6",
+		`expr (:contains(")")) 10:10`,
+		"operator , 27:27",
+		"identifier b 29:29",
+		"pclass_func expr 31:31",
+		"expr (x-1 > 2) 36:36",
+	}
+	if !reflect.DeepEqual(lexed, expected) {
+		t.Error("Unexpected tokens ", lexed)
+	}
+
+	parser, _ := CreateParserFromString(`{"a.b": 1, "c": {"d": 2}, "e": 3}`)
+	for selector, expected := range map[string][]string{
+		`.a\.b`:            {`1`},
+		`."a.b"`:           {`1`},
+		`.c *`:             {`2`, `{"d":2}`},
+		`.e:expr(x-1 = 2)`: {`3`},
+		`.e:expr(x > 2.5)`: {`3`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if !reflect.DeepEqual(getSortedEncodings(values), expected) {
+			t.Error(selector, ": expected ", expected, "; got ", values)
+		}
+	}
+
+	for selector, column := range map[string]int{
+		`numbers`:           1,
+		`.a > ?`:            6,
+		`.é:first-childish`: 3,
+		`.a:has(.b`:         7,
+		`."a`:               1,
+		`.`:                 2,
+		`.a > .`:            7,
+	} {
+		_, err := Compile(selector)
+		var syntaxError *SyntaxError
+		if !errors.As(err, &syntaxError) || syntaxError.Column != column {
+			t.Error(selector, ": expected an error at column ", column, "; got ", err)
+		}
+	}
+	if _, err := Compile(`.é:expr(x > @)`); err == nil || !strings.Contains(err.Error(), "column 13") {
+		t.Error("Expected the expression error to be positioned in the selector; got ", err)
+	}
+	if _, err := Compile(`.`); err == nil || !strings.Contains(err.Error(), "unexpected end of selector") {
+		t.Error("Expected the end of the selector to be reported; got ", err)
+	}
+}
+
+func TestSelectorCache(t *testing.T) {
+	defer SetSelectorCacheSize(DefaultSelectorCacheSize)
+	SetSelectorCacheSize(2)
+	ResetSelectorCache()
+
+	parser, _ := CreateParserFromString(`{"a": 1, "b": 2, "c": 3}`)
+	for _, selector := range []string{".a", ".b", ".a", ".c", ".b", ".a"} {
+		if _, err := parser.GetValues(selector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// .b is evicted by .c, then .a by .b.
+	expected := CacheStats{Hits: 1, Misses: 5, Evictions: 3, Entries: 2, Size: 2}
+	if stats := SelectorCacheStats(); stats != expected {
+		t.Error("Expected ", expected, "; got ", stats)
+	}
+
+	if _, err := parser.GetValues(".a:expr(x >"); err == nil {
+		t.Error("Expected an invalid selector to be rejected")
+	}
+	if _, err := parser.GetValues(".a:expr(x >"); err == nil {
+		t.Error("Expected an invalid selector to be rejected again")
+	}
+
+	SetSelectorCacheSize(0)
+	parser.GetValues(".a")
+	if stats := SelectorCacheStats(); stats.Entries != 0 || stats.Hits != 1 {
+		t.Error("Expected the disabled cache to be empty and unused; got ", stats)
+	}
+
+	SetSelectorCacheSize(DefaultSelectorCacheSize)
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			parser, _ := CreateParserFromString(fmt.Sprintf(`{"a": %d}`, i))
+			for j := 0; j < 100; j++ {
+				values, err := parser.GetValues(fmt.Sprintf(".a:expr(x = %d)", j%10))
+				if err != nil || (len(values) == 1) != (j%10 == i) {
+					t.Error("Unexpected result ", values, err, " for ", i, " and ", j%10)
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+}
+
+func TestNthChild(t *testing.T) {
+	// Adapted from the An+B vectors of the CSS parsing tests.
+	valid := map[string][2]int32{
+		"odd": {2, 1}, "even": {2, 0}, "OdD": {2, 1}, "EVEN": {2, 0}, " odd ": {2, 1},
+		"3": {0, 3}, "+2 ": {0, 2}, " -14 ": {0, -14}, "0": {0, 0},
+		"n": {1, 0}, "+n": {1, 0}, "-n": {-1, 0}, "N": {1, 0}, "-N": {-1, 0},
+		"3n": {3, 0}, "+3n": {3, 0}, "-3n": {-3, 0}, "0n": {0, 0},
+		"n+1": {1, 1}, "n-1": {1, -1}, "-n+3": {-1, 3}, "-n-3": {-1, -3},
+		"3n+1": {3, 1}, "3n-1": {3, -1}, "3n + 1": {3, 1}, "3n - 1": {3, -1},
+		"3n+ 1": {3, 1}, "3n +1": {3, 1}, "+3n-2": {3, -2}, "-3n+21": {-3, 21},
+		"10n+15": {10, 15}, "n- 1": {1, -1}, "-n- 1": {-1, -1}, "2N+1": {2, 1},
+	}
+	for arg, expected := range valid {
+		a, b, err := parseNth(arg)
+		if err != nil || a != expected[0] || b != expected[1] {
+			t.Error("Expected ", arg, " to be ", expected, "; got ", a, b, err)
+		}
+	}
+	invalid := []string{
+		"", "ödd", "+ 2", "- 2", "+ n", "- n", "3 n", "3n+", "3n-", "3n + -1", "3n+-1",
+		"3n++1", "1.5n", "2.0", "3n+1.5", "n+n", "foo", "2n+1 2", "+-3", "odd+1", "99999999999",
+	}
+	for _, arg := range invalid {
+		if a, b, err := parseNth(arg); err == nil {
+			t.Error("Expected ", arg, " to be rejected; got ", a, b)
+		}
+	}
+
+	parser, _ := CreateParserFromString(`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`)
+	for selector, expected := range map[string][]string{
+		":nth-child(3n+5)":        {"5", "8"},
+		":nth-child(-n+3)":        {"1", "2", "3"},
+		":nth-child(n+8)":         {"10", "8", "9"},
+		":nth-child(10n+15)":      nil,
+		":nth-last-child(2n+1)":   {"10", "2", "4", "6", "8"},
+		":nth-last-child(-n + 2)": {"10", "9"},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for _, selector := range []string{":nth-child(foo)", ".a :nth-last-child(3n+)", ":nth-child"} {
+		if _, err := parser.GetValues(selector); err == nil {
+			t.Error("Expected ", selector, " to be rejected")
+		}
+	}
+	if _, err := parser.GetValues(".a :nth-last-child(3n+)"); err == nil || !strings.Contains(err.Error(), "column 19") {
+		t.Error("Expected the error to give the argument's column; got ", err)
+	}
+}
+
+func TestNot(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"items": [{"id": 1, "deleted": true}, {"id": 2}, {"id": 3, "tags": ["a", "b"]}], "deleted": [4, 5]}`,
+	)
+	for selector, expected := range map[string][]string{
+		"object:not(:has(.deleted)) > .id":        {"2", "3"},
+		".items object:not(:has(.deleted)) .id":   {"2", "3"},
+		"number:not(.id)":                         {"4", "5"},
+		"number:not(:first-child, .id)":           {"5"},
+		"number:not(.deleted > *)":                {"1", "2", "3"},
+		".id:not(:expr(x < 2))":                   {"2", "3"},
+		"string:not(:not(:last-child))":           {`"b"`},
+		"object:not(:has(array), :has(.deleted))": {`{"id":2}`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for _, selector := range []string{":not()", "number:not(.a @)", ":not(.a >)"} {
+		if _, err := parser.GetValues(selector); err == nil {
+			t.Error("Expected ", selector, " to be rejected")
+		}
+	}
+}
+
+func TestIs(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"store": {"book": {"price": 8, "sale": {"price": 6}}, "magazine": {"price": 3}, "toy": {"price": 20}}, "price": 1}`,
+	)
+	for selector, expected := range map[string][]string{
+		".store :is(.book, .magazine) > .price":  {"3", "8"},
+		".store :is(.book, .magazine) .price":    {"3", "6", "8"},
+		":is(.price) ~ :is(.sale, .toy)":         {`{"price":6}`},
+		":is(.book, .toy) ~ .magazine":           {`{"price":3}`},
+		":where(.magazine, .toy) > .price":       {"20", "3"},
+		".store :is(.book, .toy) > :is(.price)":  {"20", "8"},
+		":is(.toy, .book .sale) > .price":        {"20", "6"},
+		".price:is(:expr(x > 5))":                {"20", "6", "8"},
+		".price:not(:is(:root, .book) > *)":      {"20", "3", "6"},
+		"object:is(:has(.sale), :has(:val(20)))": {`{"price":20}`, `{"price":8,"sale":{"price":6}}`},
+		".store :is(.nothing, .sale) .price":     {"6"},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for _, selector := range []string{":is()", ":where(.a,)", ":is(.a ~)"} {
+		if _, err := parser.GetValues(selector); err == nil {
+			t.Error("Expected ", selector, " to be rejected")
+		}
+	}
+}
+
+func TestSiblingCombinators(t *testing.T) {
+	document := `{"list": [1, "a", 2, "b", 3], "first": 1, "second": "x", "third": true, "fourth": 4}`
+	parser, _ := CreateParserFromString(document)
+	indexed, _ := CreateParserFromString(document, WithIndexes())
+	for selector, expected := range map[string][]string{
+		"string + number":              {"2", "3"},
+		"number + string":              {`"a"`, `"b"`, `"x"`},
+		"string ~ number":              {"2", "3", "4"},
+		":first-child ~ string":        {`"a"`, `"b"`},
+		":nth-child(2)+:last-child":    nil,
+		":nth-child(4) + *":            {"3"},
+		".first + .second":             {`"x"`},
+		".second + .first":             nil,
+		".second ~ number":             {"4"},
+		".third + *":                   {"4"},
+		".fourth ~ *":                  nil,
+		"object:has(.first + .second)": {document},
+		"number:not(string + *)":       {"1", "1", "4"},
+		".list string ~ *":             {`"b"`, "2", "3"},
+	} {
+		if expected != nil && expected[0] == document {
+			expected = []string{`{"first":1,"fourth":4,"list":[1,"a",2,"b",3],"second":"x","third":true}`}
+		}
+		for _, p := range []*Parser{parser, indexed} {
+			values, err := p.GetValues(selector)
+			if err != nil {
+				t.Error(selector, ": ", err)
+			} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+				t.Error(selector, ": expected ", expected, "; got ", encodings)
+			}
+		}
+	}
+
+	// A duplicated key keeps its first place but takes its last value.
+	parser, _ = CreateParserFromString(`{"a": 1, "b": 2, "a": 3}`)
+	if values, _ := parser.GetValues(".a + .b"); !reflect.DeepEqual(getSortedEncodings(values), []string{"2"}) {
+		t.Error("Expected .a + .b to match 2; got ", values)
+	}
+	// The order of members holds whatever was evaluated before, with or
+	// without indexes.
+	for _, opts := range [][]Option{nil, {WithIndexes()}} {
+		p, _ := CreateParserFromString(document, opts...)
+		if values, _ := p.GetValues(".second"); !reflect.DeepEqual(getSortedEncodings(values), []string{`"x"`}) {
+			t.Error("Expected .second to match \"x\"; got ", values)
+		}
+		if report, err := p.WhyNot(".third + .second", "/second"); err != nil || report.Matched {
+			t.Error("Expected .third + .second not to match /second; got ", report, err)
+		}
+		if values, _ := p.GetValues(".second ~ .fourth"); !reflect.DeepEqual(getSortedEncodings(values), []string{"4"}) {
+			t.Error("Expected .second ~ .fourth to match 4; got ", values)
+		}
+	}
+	parser, _ = CreateParserFromString(`{"b": 1, "a": 2}`)
+	parser.GetValues(".a")
+	if report, _ := parser.WhyNot(".a + .b", "/b"); report == nil || report.Reason != "node has no preceding sibling to match `.a`" {
+		t.Error("Unexpected report ", report)
+	}
+
+	// With duplicated keys, the text no longer tells the order of members,
+	// which are then ordered by key throughout.
+	parser, _ = CreateParserFromString(`{"b": 1, "c": {"y": 1, "x": 2}, "b": 3}`)
+	if values, _ := parser.GetValues(".x + .y"); !reflect.DeepEqual(getSortedEncodings(values), []string{"1"}) {
+		t.Error("Expected .x + .y to match 1; got ", values)
+	}
+
+	// Without the text of the document, members are ordered by key.
+	json, _ := simplejson.NewJson([]byte(document))
+	parser, _ = CreateParser(json)
+	if values, _ := parser.GetValues(".first + .fourth"); !reflect.DeepEqual(getSortedEncodings(values), []string{"4"}) {
+		t.Error("Expected .first + .fourth to match 4; got ", values)
+	}
+}
+
+func TestRelativeHas(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"items": [{"name": "a", "tags": {"name": "t"}}, {"tags": {"name": "u"}}, {"id": 3}], "name": "root", "after": 1}`,
+	)
+	for selector, expected := range map[string][]string{
+		"object:has(> .name) > .name":                        {`"a"`, `"root"`, `"t"`, `"u"`},
+		"object:not(:has(> .name))":                          {`{"id":3}`, `{"tags":{"name":"u"}}`},
+		".items > object:has(~ object)":                      {`{"name":"a","tags":{"name":"t"}}`, `{"tags":{"name":"u"}}`},
+		".items object:has(+ :has(> .id)) .name":             {`"u"`},
+		"*:has(+ .after)":                                    {`"root"`},
+		".items:has(~ .name)":                                {`[{"name":"a","tags":{"name":"t"}},{"tags":{"name":"u"}},{"id":3}]`},
+		".after:has(~ *)":                                    nil,
+		".name:has(+ .name)":                                 nil,
+		"object:has(> .tags:has(> .name:val(\"u\"))) .name":  {`"u"`},
+		"object:has(> :is(:scope > .id)) > *":                {"3"},
+		"object:has(:scope > .id) > *":                       {"3"},
+		":scope > .name":                                     {`"root"`},
+		".name:is(:scope > *)":                               {`"root"`},
+		"object:has(> .tags > .name)":                        {`{"name":"a","tags":{"name":"t"}}`, `{"tags":{"name":"u"}}`},
+		"object:has(> .tags > .name:val(\"t\")) > .name":     {`"a"`},
+		".items:has(> object > .id)":                         {`[{"name":"a","tags":{"name":"t"}},{"tags":{"name":"u"}},{"id":3}]`},
+		":root:has(> .items > object > .missing)":            nil,
+		":root:has(:scope > .items > object > .id) > .after": {"1"},
+		"object:has(:scope .name:val(\"u\"))":                {`{"after":1,"items":[{"name":"a","tags":{"name":"t"}},{"tags":{"name":"u"}},{"id":3}],"name":"root"}`, `{"name":"u"}`, `{"tags":{"name":"u"}}`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	program, _ := Compile("object:has(~ .b)")
+	if !strings.Contains(program.String(), "HAS 1 siblings") {
+		t.Error("Expected a sibling-relative :has; got\n", program)
+	}
+	program, _ = Compile("object:has(> .b > .c)")
+	if !strings.Contains(program.String(), "HAS 1 descendants") {
+		t.Error("Expected a descendant-relative :has; got\n", program)
+	}
+}
+
+func TestParent(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"orders": [{"id": 1, "lines": [{"sku": "X", "qty": 2}, {"sku": "Y", "qty": 1}]}, {"id": 2, "lines": [{"sku": "Z", "qty": 5}]}]}`,
+	)
+	for selector, expected := range map[string][]string{
+		`.sku:val("X"):parent > .qty`:                    {"2"},
+		`.sku:val("Z"):parent(3) > .id`:                  {"2"},
+		`.sku:val("Z"):parent:parent:parent > .id`:       {"2"},
+		`.sku:val("Y"):parent(2)`:                        {`[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]`},
+		`.sku:val("Y"):parent(2).lines`:                  {`[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]`},
+		`.sku:val("Y"):parent(2).orders`:                 nil,
+		`.qty:expr(x > 1):parent:parent:first-child`:     nil,
+		`.qty:expr(x > 1):parent(2):parent > .id`:        {"1", "2"},
+		`.orders > *:parent`:                             {`{"id":1,"lines":[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]}`, `{"id":2,"lines":[{"qty":5,"sku":"Z"}]}`},
+		`.qty:parent(5)`:                                 {`{"orders":[{"id":1,"lines":[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]},{"id":2,"lines":[{"qty":5,"sku":"Z"}]}]}`},
+		`object:has(.sku:val("X")) > .qty`:               {"2"},
+		`:is(.sku:val("X"):parent) .qty`:                 {"2"},
+		`:not(.sku:val("X"):parent) > .qty`:              {"1", "5"},
+		`object:has(.sku):parent`:                        {`[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]`, `[{"qty":5,"sku":"Z"}]`},
+		`:has(.sku:val("Z")):parent(2) > .id`:            {"2"},
+		`object:not(:root):parent(2) > .id`:              {"1", "2"},
+		`object:is(:has(.qty:expr(x = 1))):parent`:       {`[{"qty":2,"sku":"X"},{"qty":1,"sku":"Y"}]`},
+		`.qty:expr(x = 5):parent:has(.sku):parent.lines`: {`[{"qty":5,"sku":"Z"}]`},
+		`.sku:parent:parent.lines:parent > .id`:          {"1", "2"},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for _, selector := range []string{".a:parent(0)", ".a:parent(x)", ".a:parent(-1)", `.sku:val("X") :parent`, ".orders > :parent(2)"} {
+		if _, err := parser.GetValues(selector); err == nil {
+			t.Error("Expected ", selector, " to be rejected")
+		}
+	}
+	if _, err := parser.GetValues(`.sku:val("X") :parent`); err == nil || !strings.Contains(err.Error(), "column 15") {
+		t.Error("Expected the error for a detached :parent to point to it; got ", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"files": ["a/b.go", "README.md", "main_test.go", "Makefile"], "size": 10, "note": "Line one\nline (two)"}`,
+	)
+	for selector, expected := range map[string][]string{
+		`string:matches(/\.go$/)`:                        {`"a/b.go"`, `"main_test.go"`},
+		`string:matches(/^m/i)`:                          {`"Makefile"`, `"main_test.go"`},
+		`string:matches(/^line/m)`:                       {`"Line one\nline (two)"`},
+		`string:matches(/one.line/s)`:                    {`"Line one\nline (two)"`},
+		`string:matches(/a\/b/)`:                         {`"a/b.go"`},
+		`string:matches(/\(two\)/)`:                      {`"Line one\nline (two)"`},
+		`:matches(/1/)`:                                  nil,
+		`string:expr(x ~= /_test\./)`:                    {`"main_test.go"`},
+		`string:expr(x ~= "^[A-Z]" && x $= "file")`:      {`"Makefile"`},
+		`.files string:expr(x ~= /\.GO$/i = false)`:      {`"Makefile"`, `"README.md"`},
+		`:expr(x ~= /0/)`:                                nil,
+		`.size:expr(x / 2 = 5)`:                          {`10`},
+		`string:not(:matches(/^[a-z]/)):expr(x ~= /e/i)`: {`"Line one\nline (two)"`, `"Makefile"`, `"README.md"`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	// Patterns are compiled along with the selector.
+	for selector, message := range map[string]string{
+		`string:matches(/a(/)`:    "Invalid regular expression /a(/ at column 16",
+		`string:matches(/a/g)`:    `Unknown flag 'g'`,
+		`string:matches("a")`:     "Invalid argument to :matches",
+		`string:matches(/a/ = 1)`: "Invalid argument to :matches",
+		`string:matches(/a)`:      "unterminated regular expression",
+		`string:expr(x ~= "[")`:   `Invalid regular expression "[" at column 18`,
+		`string:expr(x ~= x)`:     "Expected a regular expression after ~=",
+		`string:expr(/a/ = x)`:    "Unexpected /a/ in expression",
+	} {
+		if _, err := Compile(selector); err == nil || !strings.Contains(err.Error(), message) {
+			t.Error(selector, ": expected an error containing ", message, "; got ", err)
+		}
+	}
+
+	program, err := Compile(`string:matches(/^A/i):expr(x ~= /\.go$/)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := program.MarshalBinary()
+	var decoded Program
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	values, err := parser.GetCompiledValues(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, []string{`"a/b.go"`}) {
+		t.Error("Unexpected values ", encodings)
+	}
+}
+
+func TestKeyPatterns(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"metric_cpu_p99": 1, "metric_mem_p99": 2, "metric_cpu_p50": 3, "Metric_Disk_P99": 4, "x-trace": "a", "a*b": 5, "list": [6, {"": 7}]}`,
+	)
+	for selector, expected := range map[string][]string{
+		`.metric_*`:                            {"1", "2", "3"},
+		`.metric_*_p99`:                        {"1", "2"},
+		`.metric_???_p99`:                      {"1", "2"},
+		`.a\*b`:                                {"5"},
+		`."a*b"`:                               {"5"},
+		`number.*:expr(x > 4)`:                 {"5", "7"},
+		`:key(/^metric_.*_p99$/)`:              {"1", "2"},
+		`:key(/^metric_.*_p99$/i)`:             {"1", "2", "4"},
+		`:key(metric_*_p99 i)`:                 {"1", "2", "4"},
+		`:key(METRIC_CPU_P99 i)`:               {"1"},
+		`:key("x-trace")`:                      {`"a"`},
+		`:key(  "A*B" i )`:                     {"5"},
+		`:key(/^$/)`:                           {"7"},
+		`:expr(key() ^= "x-")`:                 {`"a"`},
+		`number:expr(key() $= "p99" && x > 1)`: {"2"},
+		`.list > *:expr(key() = null)`:         {"6", `{"":7}`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for selector, message := range map[string]string{
+		`:key(/a(/)`:         "Invalid regular expression",
+		`:key(a > .b)`:       "Invalid argument to :key",
+		`:key(.a)`:           "unexpected",
+		`:expr(key(x))`:      "Wrong number of arguments to key() at column 7: expected 0, got 1",
+		`:expr(key)`:         `unexpected "key"`,
+		`:expr(nokey() = 1)`: "unknown function nokey()",
+		`:expr(key(1 2))`:    "Unterminated call of key()",
+	} {
+		if _, err := Compile(selector); err == nil || !strings.Contains(err.Error(), message) {
+			t.Error(selector, ": expected an error containing ", message, "; got ", err)
+		}
+	}
+}
+
+func TestNodeFunctions(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"items": ["a", "b", "c", "d"], "config": {"a": 1, "b": 2, "c": {"d": {"e": [true]}}}, "a_rather_long_key_name": null}`,
+	)
+	for selector, expected := range map[string][]string{
+		`.items > *:expr(index() < 2)`:                                        {`"a"`, `"b"`},
+		`string:expr(index() = siblings() - 1)`:                               {`"d"`},
+		`:expr(index() = null && depth() = 1)`:                                {`["a","b","c","d"]`, `null`, `{"a":1,"b":2,"c":{"d":{"e":[true]}}}`},
+		`.config > *:expr(siblings() = 3 && x > 1)`:                           {"2"},
+		`*:expr(depth() > 3)`:                                                 {`[true]`, `true`},
+		`:expr(size(x) > 3)`:                                                  {`["a","b","c","d"]`},
+		`object:expr(size(x) = 3)`:                                            {`{"a":1,"b":2,"c":{"d":{"e":[true]}}}`, `{"a_rather_long_key_name":null,"config":{"a":1,"b":2,"c":{"d":{"e":[true]}}},"items":["a","b","c","d"]}`},
+		`:expr(type(x) = "boolean")`:                                          {"true"},
+		`:root:expr(type(x) = "object" && siblings() = null && key() = null)`: {`{"a_rather_long_key_name":null,"config":{"a":1,"b":2,"c":{"d":{"e":[true]}}},"items":["a","b","c","d"]}`},
+		`:expr(size(x) = null && type(x) = "null")`:                           {"null"},
+		`.config :has(:expr(depth() = 4))`:                                    {`{"e":[true]}`},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for _, selector := range []string{`:expr(size() > 1)`, `:expr(type(x, x))`, `:expr(depth(x) > 1)`, `:expr(index > 1)`} {
+		if _, err := Compile(selector); err == nil {
+			t.Error("Expected `", selector, "` to be rejected")
+		}
+	}
+}
+
+func TestFunctionLibrary(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"answer": " YES ", "title": "A rather long title", "tags": "a,b,c", "delta": -7.5, "counts": [3, 12, "4"], "flag": true}`,
+	)
+	for selector, expected := range map[string][]string{
+		`:expr(lower(trim(x)) = "yes")`:                         {`" YES "`},
+		`:expr(upper(x) = "A,B,C")`:                             {`"a,b,c"`},
+		`:expr(len(x) > 10)`:                                    {`"A rather long title"`},
+		`:expr(trim(x) != "" && len(trim(x)) < 4)`:              {`" YES "`, `"4"`},
+		`:expr(substr(x, 2, 6) = "rather")`:                     {`"A rather long title"`},
+		`:expr(substr(x, -5) = "title")`:                        {`"A rather long title"`},
+		`:expr(substr(x, 1, 100) = ",b,c")`:                     {`"a,b,c"`},
+		`:expr(replace(x, ",", "") = "abc")`:                    {`"a,b,c"`},
+		`:expr(split-count(x, ",") = 3)`:                        {`"a,b,c"`},
+		`:expr(abs(x) > 5)`:                                     {"-7.5", "12"},
+		`:expr(floor(x) = -8 && ceil(x) = -7 && round(x) = -8)`: {"-7.5"},
+		`.counts > *:expr(max(x, 5) = x)`:                       {"12"},
+		`.counts > *:expr(min(x, 5, 4) = x)`:                    {"3"},
+		`.counts > *:expr(number(x) > 3.5)`:                     {`"4"`, "12"},
+		`:expr(string(x) = "true")`:                             {"true"},
+		`:expr(number(x) = 1 && type(x) = "boolean")`:           {"true"},
+		`.counts > *:expr(string(x) = "12")`:                    {"12"},
+		`.counts > *:expr(index()-1 = 1)`:                       {`"4"`},
+		`.counts:expr(size(x) - 1 = 2)`:                         {`[3,12,"4"]`},
+		`:expr(x < "5")`:                                        {`"4"`},
+		`:expr(lower(x) = "yes")`:                               nil,
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	for selector, message := range map[string]string{
+		`:expr(lower(1) = "1")`:     "Argument 1 of lower() at column 7 must be a string, not a number",
+		`:expr(abs(len(x)) > 1)`:    "",
+		`:expr(abs(upper(x)) > 1)`:  "Argument 1 of abs() at column 7 must be a number, not a string",
+		`:expr(replace(x, 1, "a"))`: "Argument 2 of replace()",
+		`:expr(max(x, 1, "2") = 2)`: "Argument 3 of max()",
+		`:expr(len(x = 1))`:         "must be a string, not a boolean",
+		`:expr(substr(x) = "")`:     "expected 2 to 3, got 1",
+		`:expr(max() = 1)`:          "expected at least 1, got 0",
+		`:expr(trim(x, x) = "")`:    "expected 1, got 2",
+		`:expr(split(x, ",") = 1)`:  "unknown function split()",
+		`:expr(x, 1)`:               "Unterminated expression",
+	} {
+		_, err := Compile(selector)
+		if message == "" && err != nil {
+			t.Error(selector, ": ", err)
+		} else if message != "" && (err == nil || !strings.Contains(err.Error(), message)) {
+			t.Error(selector, ": expected an error containing ", message, "; got ", err)
+		}
+	}
+}
+
+func TestExpressionPaths(t *testing.T) {
+	parser, _ := CreateParserFromString(
+		`{"max": 10, "items": [{"name": "a", "price": 5, "cost": 3, "stock": {"min": 2, "level": 1}}, {"name": "b", "price": 4, "cost": 6, "stock": {"min": 1, "level": 12}}, {"name": "c", "price": 12, "cost": 1}], "range": {"start": 3, "end": 2, "odd key": 1}}`,
+	)
+	for selector, expected := range map[string][]string{
+		`object:expr(.price > .cost) > .name`:                              {`"a"`, `"c"`},
+		`object:expr(.stock.level < .stock.min) > .name`:                   {`"a"`},
+		`.items .level:expr(x > ../min)`:                                   {"12"},
+		`object:expr(.price > ../../max) > .name`:                          {`"c"`},
+		`.level:expr(x > ../../../../max)`:                                 {"12"},
+		`object:expr(.price * 2 > ../../max && .cost < .price)`:            {`{"cost":1,"name":"c","price":12}`},
+		`object:expr(.end < .start)`:                                       {`{"end":2,"odd key":1,"start":3}`},
+		`object:expr(."odd key" = 1)`:                                      {`{"end":2,"odd key":1,"start":3}`},
+		`object:expr(.stock = null) > .name`:                               {`"c"`},
+		`object:has(.stock:expr(.level > ../price)) > .name`:               {`"b"`},
+		`object:expr(type(.stock) = "object" && size(.stock) = 2) > .name`: {`"a"`, `"b"`},
+		`:root:expr(.max / 2 = 5 && .. = null) > .max`:                     {"10"},
+	} {
+		values, err := parser.GetValues(selector)
+		if err != nil {
+			t.Error(selector, ": ", err)
+		} else if encodings := getSortedEncodings(values); !reflect.DeepEqual(encodings, expected) {
+			t.Error(selector, ": expected ", expected, "; got ", encodings)
+		}
+	}
+
+	program, err := Compile(`object:expr(.a."b.c" > ../../x && .d = null)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`PUSH_PATH ".a.\"b.c\""`, `PUSH_PATH "../../x"`, `PUSH_PATH ".d"`} {
+		if !strings.Contains(program.String(), expected) {
+			t.Error("Expected `", expected, "` in the program; got\n", program.String())
+		}
+	}
+	encoded, _ := program.MarshalBinary()
+	var decoded Program
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.paths, program.paths) {
+		t.Error("Expected the decoded paths to be identical; got ", decoded.paths)
+	}
+
+	for _, selector := range []string{`:expr(. > 1)`, `:expr(.a. > 1)`, `:expr(.a* > 1)`, `:expr(.."a" > 1)`} {
+		if _, err := Compile(selector); err == nil {
+			t.Error("Expected `", selector, "` to be rejected")
+		}
+	}
+}
+
+func TestGetValuesFromBytes(t *testing.T) {
+	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
+	document := `{"user": {"id": 1, "name": "A\u00e9", "tags": ["a", "b"]}, "items": [{"sku": "x", "id": 2.5e1}, {"sku": null, "": 3}]}`
+
+	for _, test := range []struct {
+		document string
+		selector string
+		raw      bool
+	}{
+		{document, ".user .id", true},
+		{document, ".items > object > .sku", true},
+		{document, "string", true},
+		{document, "object > *", true},
+		{document, ".user", true},
+		{document, ".name", true},
+		{document, "number", true},
+		{document, `."id"`, true},
+		{document, ".items string", true},
+		{document, ".user .tags > string", true},
+		{document, ".tags string:first-child", false},
+		{document, ".user, .items", false},
+		{string(json_ast), ".Link .Keyword", true},
+		{string(json_ast), "object > .Name array", true},
+	} {
+		_, raw, err := compileRawSelector(test.selector)
+		if err != nil || raw != test.raw {
+			t.Error("Expected ", test.selector, " to use the raw scanner: ", test.raw, "; got ", raw, err)
+		}
+
+		parser, _ := CreateParserFromString(test.document)
+		expected, _ := parser.GetValues(test.selector)
+		actual, err := GetValuesFromBytes([]byte(test.document), test.selector)
+		if err != nil {
+			t.Error("Selector ", test.selector, " failed: ", err)
+		}
+		if !reflect.DeepEqual(getSortedEncodings(expected), getSortedEncodings(actual)) {
+			t.Error("Raw results for ", test.selector, " differ: ", actual, " != ", expected)
+		}
+	}
+
+	for _, invalid := range []string{``, `{"a": }`, `{"a": 1`, `[1, 2,]`, `{"a" 1}`, `"\x"`, `-`, `tru`} {
+		if _, err := GetValuesFromBytes([]byte(invalid), ".a"); err == nil {
+			t.Error("Expected an error scanning ", invalid)
+		}
+	}
+
+	raw, _, _ := compileRawSelector(".items > object > .missing")
+	body := []byte(document)
+	if allocs := testing.AllocsPerRun(100, func() { raw.getValues(body) }); allocs != 0 {
+		t.Error("Expected scanning without matches not to allocate; got ", allocs)
+	}
+}
+
+const benchmarkLexSelector = `.beers object:has(.rating:expr(x > 70)) > .title, :root > .count:nth-child(2n+1)`
+
+func BenchmarkLex(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lex(benchmarkLexSelector, selectorScanner)
+	}
+}
+
+// regexScanner is the table of patterns selectors used to be lexed with,
+// each tried in turn at every position, kept to compare lex against.
+var regexScanner = []struct {
+	regex *regexp.Regexp
+	typ   tokenType
+}{
+	{regexp.MustCompile(`^\([^\)]+\)`), S_EXPR},
+	{regexp.MustCompile(`^\s*[~*,> ]\s*`), S_OPER},
+	{regexp.MustCompile(`^\s`), S_EMPTY},
+	{regexp.MustCompile(`^(-?\d+(\.\d*)([eE][+\-]?\d+)?)`), S_FLOAT},
+	{regexp.MustCompile(`^string|boolean|null|array|object|number`), S_TYPE},
+	{regexp.MustCompile(`^\"([_a-zA-Z]|\\[^\s0-9a-fA-F])([_a-zA-Z0-9\-]|(\\[^\s0-9a-fA-F]))*\"`), S_WORD},
+	{regexp.MustCompile(`^\.?\"([^"\\]|\\[^"])*\"`), S_QUOTED_IDENTIFIER},
+	{regexp.MustCompile(`^\.([_a-zA-Z]|\\[^\s0-9a-fA-F])([_a-zA-Z0-9\-]|(\\[^\s0-9a-fA-F]))*`), S_IDENTIFIER},
+	{regexp.MustCompile(`^:(root|empty|first-child|last-child|only-child)`), S_PCLASS},
+	{regexp.MustCompile(`^:(has|expr|val|contains)\s*`), S_PCLASS_FUNC},
+	{regexp.MustCompile(`^:(nth-child|nth-last-child)\s*`), S_NTH_FUNC},
+	{regexp.MustCompile(`^(&&|\|\||[\$\^<>!\*]=|[=+\-*/%<>])`), S_BINOP},
+	{regexp.MustCompile(`^true|false`), S_BOOL},
+	{regexp.MustCompile(`^null`), S_NIL},
+	{regexp.MustCompile(`^n`), S_PVAR},
+	{regexp.MustCompile(`^odd|even`), S_KEYWORD},
+}
+
+// regexLex lexes input the way selectors used to be, up to the values of
+// the tokens, which were then converted much as lex does.
+func regexLex(input string) ([]*token, error) {
+	input = strings.TrimSpace(input)
+	var tokens []*token
+	for start := 0; start < len(input); {
+		rest := input[start:]
+		matched := false
+		for _, scanner := range regexScanner {
+			if !scanner.regex.MatchString(rest) {
+				continue
+			}
+			idx := scanner.regex.FindStringIndex(rest)
+			if idx[0] != 0 {
+				continue
+			}
+			end := idx[1]
+			if scanner.typ == S_EXPR && strings.Count(rest[:end], "(") != strings.Count(rest[:end], ")") {
+				for end <= len(rest) && strings.Count(rest[:end], "(") != strings.Count(rest[:end], ")") {
+					end++
+				}
+				if end > len(rest) {
+					return nil, errors.New(fmt.Sprintf("Unterminated expression: %s", rest))
+				}
+			}
+			if scanner.typ != S_EMPTY {
+				tokens = append(tokens, &token{typ: scanner.typ, val: rest[:end]})
+			}
+			start += end
+			matched = true
+			break
+		}
+		if !matched {
+			return nil, errors.New(fmt.Sprintf("Selector parsing error at %s", rest))
+		}
+	}
+	return tokens, nil
+}
+
+// BenchmarkLexRegexTable lexes the selector of BenchmarkLex with the old
+// pattern table, which takes some twenty times as long, without even
+// converting the values of the tokens.
+func BenchmarkLexRegexTable(b *testing.B) {
+	if _, err := regexLex(benchmarkLexSelector); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		regexLex(benchmarkLexSelector)
+	}
+}
+
 func BenchmarkParseDocument(b *testing.B) {
 	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
 	b.ResetTimer()
@@ -224,6 +1356,19 @@ func BenchmarkParseDocument(b *testing.B) {
 	}
 }
 
+// BenchmarkMapDocument maps the 40,000 nodes of example_json_ast.json, which
+// takes about 1.9MB in a couple dozen allocations; mapping a node per
+// allocation used to take 7.3MB in 188,000.
+func BenchmarkMapDocument(b *testing.B) {
+	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
+	document, _ := simplejson.NewJson(json_ast)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parser, _ = CreateParser(document)
+	}
+}
+
 func BenchmarkBasicSelector(b *testing.B) {
 	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
 	parser, _ = CreateParserFromString(string(json_ast))
@@ -259,3 +1404,39 @@ func BenchmarkHasExpression(b *testing.B) {
 		values, _ = parser.GetValues(`object:has(.Str:val("News"))`)
 	}
 }
+
+func BenchmarkRawSelector(b *testing.B) {
+	document := []byte(`{"user": {"id": 1, "name": "a"}, "items": [{"sku": "x"}, {"sku": "y"}]}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		values, _ = GetValuesFromBytes(document, ".items > object > .sku")
+	}
+}
+
+func BenchmarkParsedRawSelector(b *testing.B) {
+	document := `{"user": {"id": 1, "name": "a"}, "items": [{"sku": "x"}, {"sku": "y"}]}`
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parser, _ = CreateParserFromString(document)
+		values, _ = parser.GetValues(".items > object > .sku")
+	}
+}
+
+func BenchmarkCompiledSelector(b *testing.B) {
+	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
+	parser, _ = CreateParserFromString(string(json_ast))
+	program, _ := Compile(`.Link object:has(.Str:val("News"))`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values, _ = parser.GetCompiledValues(program)
+	}
+}
+
+func BenchmarkIndexedBasicSelector(b *testing.B) {
+	json_ast, _ := ioutil.ReadFile("./test_data/example_json_ast.json")
+	parser, _ = CreateParserFromString(string(json_ast), WithIndexes())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values, _ = parser.GetValues(`.Link`)
+	}
+}
@@ -1,11 +1,11 @@
 package jsonselect
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
-	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type tokenType string
@@ -13,19 +13,20 @@ type tokenType string
 type token struct {
 	typ tokenType
 	val interface{}
-}
-
-type scannerItem struct {
-	regex *regexp.Regexp
-	typ   tokenType
+	// pos is the byte offset of the token in the selector, and column its
+	// position in runes, counting from 1.
+	pos    int
+	column int
 }
 
 const (
 	S_TYPE              tokenType = "type"
 	S_IDENTIFIER        tokenType = "identifier"
+	S_KEY_PATTERN       tokenType = "key_pattern"
 	S_QUOTED_IDENTIFIER tokenType = "quoted_identifier"
 	S_PCLASS            tokenType = "pclass"
 	S_PCLASS_FUNC       tokenType = "pclass_func"
+	S_PARENT            tokenType = "parent"
 	S_NTH_FUNC          tokenType = "nth_func"
 	S_OPER              tokenType = "operator"
 	S_EMPTY             tokenType = "empty"
@@ -40,217 +41,573 @@ const (
 	S_EXPR              tokenType = "expr"
 	S_NUMBER            tokenType = "number"
 	S_STRING            tokenType = "string"
+	S_REGEX             tokenType = "regex"
+	S_FUNCTION          tokenType = "function"
+	S_PATH              tokenType = "path"
 	S_PAREN             tokenType = "paren"
 )
 
-var selectorScanner = []scannerItem{
-	scannerItem{
-		regexp.MustCompile(`^\([^\)]+\)`),
-		S_EXPR,
-	},
-	scannerItem{
-		// we match any of the operators and all surrounding whitespace
-		// to ensure we don't get extra space operators
-		regexp.MustCompile(`^\s*[~*,> ]\s*`),
-		S_OPER,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\s`),
-		S_EMPTY,
-	},
-	scannerItem{
-		regexp.MustCompile(`^(-?\d+(\.\d*)([eE][+\-]?\d+)?)`),
-		S_FLOAT,
-	},
-	scannerItem{
-		regexp.MustCompile(`^string|boolean|null|array|object|number`),
-		S_TYPE,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\"([_a-zA-Z]|\\[^\s0-9a-fA-F])([_a-zA-Z0-9\-]|(\\[^\s0-9a-fA-F]))*\"`),
-		S_WORD,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\.?\"([^"\\]|\\[^"])*\"`),
-		S_QUOTED_IDENTIFIER,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\.([_a-zA-Z]|\\[^\s0-9a-fA-F])([_a-zA-Z0-9\-]|(\\[^\s0-9a-fA-F]))*`),
-		S_IDENTIFIER,
-	},
-	scannerItem{
-		regexp.MustCompile(`^:(root|empty|first-child|last-child|only-child)`),
-		S_PCLASS,
-	},
-	scannerItem{
-		// we match any trailing whitespace to ensure that we don't get a space operator
-		// if whitespace exists before the expression. We must support whitespace before
-		// the expression in order to pass the basic_has-whitespace test.
-		regexp.MustCompile(`^:(has|expr|val|contains)\s*`),
-		S_PCLASS_FUNC,
-	},
-	scannerItem{
-		// we match any trailing whitespace to ensure that we don't get a space operator
-		// if whitespace exists before the expression. We must support whitespace before
-		// the expression in order to pass the basic_has-whitespace test.
-		regexp.MustCompile(`^:(nth-child|nth-last-child)\s*`),
-		S_NTH_FUNC,
-	},
-	scannerItem{
-		regexp.MustCompile(`^(&&|\|\||[\$\^<>!\*]=|[=+\-*/%<>])`),
-		S_BINOP,
-	},
-	scannerItem{
-		regexp.MustCompile(`^true|false`),
-		S_BOOL,
-	},
-	scannerItem{
-		regexp.MustCompile(`^null`),
-		S_NIL,
-	},
-	scannerItem{
-		regexp.MustCompile(`^n`),
-		S_PVAR,
-	},
-	scannerItem{
-		regexp.MustCompile(`^odd|even`),
-		S_KEYWORD,
-	},
+// scannerMode selects the grammar lex tokenizes: selectors, or the
+// arguments of `:expr`.
+type scannerMode int
+
+const (
+	selectorScanner scannerMode = iota
+	expressionScanner
+)
+
+var pseudoClasses = map[string]tokenType{
+	"root":           S_PCLASS,
+	"empty":          S_PCLASS,
+	"scope":          S_PCLASS,
+	"parent":         S_PARENT,
+	"first-child":    S_PCLASS,
+	"last-child":     S_PCLASS,
+	"only-child":     S_PCLASS,
+	"has":            S_PCLASS_FUNC,
+	"expr":           S_PCLASS_FUNC,
+	"val":            S_PCLASS_FUNC,
+	"contains":       S_PCLASS_FUNC,
+	"matches":        S_PCLASS_FUNC,
+	"key":            S_PCLASS_FUNC,
+	"not":            S_PCLASS_FUNC,
+	"is":             S_PCLASS_FUNC,
+	"where":          S_PCLASS_FUNC,
+	"nth-child":      S_NTH_FUNC,
+	"nth-last-child": S_NTH_FUNC,
 }
 
-var expressionScanner = []scannerItem{
-	scannerItem{
-		regexp.MustCompile(`^\s`),
-		S_EMPTY,
-	},
-	scannerItem{
-		regexp.MustCompile(`^true|false`),
-		S_BOOL,
-	},
-	scannerItem{
-		regexp.MustCompile(`^null`),
-		S_NIL,
-	},
-	scannerItem{
-		regexp.MustCompile(`^-?\d+(\.\d*)?([eE][+\-]?\d+)?`),
-		S_NUMBER,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\"([^\]|\[^\"])*\"`),
-		S_STRING,
-	},
-	scannerItem{
-		regexp.MustCompile(`^x`),
-		S_PVAR,
-	},
-	scannerItem{
-		regexp.MustCompile(`^(&&|\|\||[\$\^<>!\*]=|[=+\-*/%<>])`),
-		S_BINOP,
-	},
-	scannerItem{
-		regexp.MustCompile(`^\(|\)`),
-		S_PAREN,
-	},
+var typeNames = map[string]bool{
+	"string":  true,
+	"boolean": true,
+	"null":    true,
+	"array":   true,
+	"object":  true,
+	"number":  true,
 }
 
-func lexNextToken(input string, scanners []scannerItem) (*token, int, error) {
-	for _, scanner := range scanners {
-		if scanner.regex.MatchString(input) {
-			idx := scanner.regex.FindStringIndex(input)
-			if idx[0] == 0 {
-				if scanner.typ == S_EXPR && strings.Count(input[idx[0]:idx[1]], "(") != strings.Count(input[idx[0]:idx[1]], ")") {
-					terminated := false
-					var curr int
-					for curr = idx[1]; curr <= len(input[idx[0]:]); curr++ {
-						if strings.Count(input[idx[0]:curr], "(") == strings.Count(input[idx[0]:curr], ")") {
-							terminated = true
-							break
-						}
-					}
-					if terminated == false {
-						return nil, len(input), errors.New(fmt.Sprintf("Unterminated expression: %s", input[idx[0]:curr-1]))
-					} else {
-						idx[1] = curr
+// SyntaxError reports where a selector could not be tokenized.
+type SyntaxError struct {
+	Msg string
+	// Offset is the byte offset of the error in the selector, and Column
+	// its position in runes, counting from 1.
+	Offset int
+	Column int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Selector parsing error at column %d: %s", e.Column, e.Msg)
+}
+
+// lexer scans its input in a single pass, one token at a time.
+type lexer struct {
+	input  string
+	mode   scannerMode
+	start  int
+	pos    int
+	end    int
+	column int
+	// startColumn is the column of start.
+	startColumn int
+	tokens      []token
+}
+
+func lex(input string, mode scannerMode) ([]*token, error) {
+	return lexAt(input, mode, 0, 1)
+}
+
+// lexAt lexes input as if it were found at byte offset pos and rune column
+// of a selector, so that tokens and errors are positioned within it.
+func lexAt(input string, mode scannerMode, pos int, column int) ([]*token, error) {
+	// Surrounding whitespace is not an operator.
+	trimmed := strings.TrimLeft(input, " \t\n\r\f")
+	l := &lexer{
+		input:  input,
+		mode:   mode,
+		pos:    len(input) - len(trimmed),
+		end:    len(strings.TrimRight(input, " \t\n\r\f")),
+		column: column + len(input) - len(trimmed),
+		// Tokens are rarely shorter than this.
+		tokens: make([]token, 0, len(input)/4+1),
+	}
+
+	for l.pos < l.end {
+		l.start, l.startColumn = l.pos, l.column
+		var err *SyntaxError
+		if l.mode == selectorScanner {
+			err = l.selectorToken()
+		} else {
+			err = l.expressionToken()
+		}
+		if err != nil {
+			err.Offset += pos
+			return nil, err
+		}
+	}
+
+	tokens := make([]*token, len(l.tokens))
+	for i := range l.tokens {
+		l.tokens[i].pos += pos
+		tokens[i] = &l.tokens[i]
+	}
+	return tokens, nil
+}
+
+// peek returns the byte at offset i from the current position, or 0 past
+// the end of the input.
+func (l *lexer) peek(i int) byte {
+	if l.pos+i < l.end {
+		return l.input[l.pos+i]
+	}
+	return 0
+}
+
+// advance moves past the next n bytes, which must hold whole runes.
+func (l *lexer) advance(n int) {
+	for _, c := range []byte(l.input[l.pos : l.pos+n]) {
+		// Count the first byte of every rune.
+		if c < utf8.RuneSelf || c >= 0xC0 {
+			l.column++
+		}
+	}
+	l.pos += n
+}
+
+func (l *lexer) emit(typ tokenType, val interface{}) {
+	l.tokens = append(l.tokens, token{typ, val, l.start, l.startColumn})
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Msg: fmt.Sprintf(format, args...), Offset: l.start, Column: l.startColumn}
+}
+
+// unexpected reports the rune at the current position, or the end of the
+// input if there is none.
+func (l *lexer) unexpected() *SyntaxError {
+	l.start, l.startColumn = l.pos, l.column
+	if l.pos >= l.end && l.mode == expressionScanner {
+		return l.errorf("unexpected end of expression")
+	} else if l.pos >= l.end {
+		return l.errorf("unexpected end of selector")
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[l.pos:l.end])
+	return l.errorf("unexpected %q", r)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func (l *lexer) skipSpace() {
+	for isSpace(l.peek(0)) {
+		l.advance(1)
+	}
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (l *lexer) selectorToken() *SyntaxError {
+	c := l.peek(0)
+	switch {
+	case isSpace(c):
+		// Whitespace around an operator belongs to it; on its own it is
+		// the descendant operator.
+		l.skipSpace()
+		switch l.peek(0) {
+		case '~', '+', ',', '>':
+			l.start, l.startColumn = l.pos, l.column
+			return l.selectorToken()
+		}
+		l.emit(S_OPER, " ")
+	case c == '~' || c == '+' || c == ',' || c == '>':
+		l.advance(1)
+		l.skipSpace()
+		l.emit(S_OPER, string(c))
+	case c == '*':
+		l.advance(1)
+		l.emit(S_OPER, "*")
+	case c == '(':
+		return l.parenthesized()
+	case c == '.':
+		l.advance(1)
+		if l.peek(0) == '"' {
+			value, err := l.quoted()
+			if err != nil {
+				return err
+			}
+			l.emit(S_IDENTIFIER, value)
+			return nil
+		}
+		name, glob, ok := l.name()
+		if !ok {
+			return l.unexpected()
+		}
+		if glob {
+			l.emit(S_KEY_PATTERN, name)
+		} else {
+			l.emit(S_IDENTIFIER, name)
+		}
+	case c == '"':
+		value, err := l.quoted()
+		if err != nil {
+			return err
+		}
+		l.emit(S_WORD, value)
+	case c == ':':
+		l.advance(1)
+		name := l.word()
+		typ, ok := pseudoClasses[name]
+		if !ok {
+			return l.errorf("unknown pseudo-class %q", ":"+name)
+		}
+		if typ != S_PCLASS {
+			// Allow whitespace before the argument.
+			i := 0
+			for isSpace(l.peek(i)) {
+				i++
+			}
+			if l.peek(i) == '(' {
+				l.advance(i)
+			}
+		}
+		l.emit(typ, name)
+	case isLetter(c):
+		name := l.word()
+		if !typeNames[name] {
+			return l.errorf("unknown type %q", name)
+		}
+		l.emit(S_TYPE, name)
+	default:
+		return l.unexpected()
+	}
+	return nil
+}
+
+// word consumes a run of letters and hyphens.
+func (l *lexer) word() string {
+	i := 0
+	for c := l.peek(i); isLetter(c) || c == '-'; c = l.peek(i) {
+		i++
+	}
+	word := l.input[l.pos : l.pos+i]
+	l.advance(i)
+	return word
+}
+
+// name consumes an unquoted key, resolving any backslash escapes, and
+// reports whether there was one.  A key holding an unescaped `*` or `?` is
+// a glob, which is returned with its escapes for keyGlobPattern to
+// translate.
+func (l *lexer) name() (name string, glob bool, ok bool) {
+	var escaped bool
+	i := 0
+	for {
+		c := l.peek(i)
+		switch {
+		case isLetter(c) || c == '_' || c >= utf8.RuneSelf:
+		case c == '*' || c == '?':
+			glob = true
+		case (isDigit(c) || c == '-') && i > 0:
+		case c == '\\' && l.peek(i+1) != 0 && !isSpace(l.peek(i+1)) && !isHexDigit(l.peek(i+1)):
+			escaped = true
+			_, size := utf8.DecodeRuneInString(l.input[l.pos+i+1 : l.end])
+			i += size
+		default:
+			name := l.input[l.pos : l.pos+i]
+			l.advance(i)
+			if escaped && !glob {
+				var unescaped strings.Builder
+				for j := 0; j < len(name); j++ {
+					if name[j] == '\\' {
+						j++
 					}
+					unescaped.WriteByte(name[j])
 				}
-				token := getToken(
-					scanner.typ,
-					input[idx[0]:idx[1]],
-				)
-				return &token, idx[1], nil
+				name = unescaped.String()
+			}
+			return name, glob, i > 0
+		}
+		i++
+	}
+}
+
+// quoted consumes a JSON string and returns its value.
+func (l *lexer) quoted() (string, *SyntaxError) {
+	var escaped bool
+	i := 1
+	for {
+		switch l.peek(i) {
+		case 0:
+			if l.pos+i >= l.end {
+				return "", l.errorf("unterminated string")
+			}
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			raw := l.input[l.pos : l.pos+i+1]
+			l.advance(i + 1)
+			if !escaped {
+				return raw[1 : len(raw)-1], nil
 			}
+			var value string
+			if err := json.Unmarshal([]byte(raw), &value); err != nil {
+				return "", l.errorf("invalid string %s", raw)
+			}
+			return value, nil
 		}
+		i++
 	}
-	return nil, len(input), errors.New(fmt.Sprintf("Selector parsing error at %s", input))
 }
 
-func lex(input string, scanners []scannerItem) ([]*token, error) {
+// parenthesized consumes a parenthesized argument, including any nested
+// parentheses and strings, as a single S_EXPR token.
+func (l *lexer) parenthesized() *SyntaxError {
+	depth := 0
+	for i := 0; l.pos+i < l.end; i++ {
+		switch l.input[l.pos+i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				if i == 1 {
+					return l.errorf("empty argument")
+				}
+				l.advance(i + 1)
+				l.emit(S_EXPR, l.input[l.start:l.pos])
+				return nil
+			}
+		case '"':
+			// Skip the string, parentheses and all.
+			for i++; l.pos+i < l.end && l.input[l.pos+i] != '"'; i++ {
+				if l.input[l.pos+i] == '\\' {
+					i++
+				}
+			}
+		case '/':
+			// So is a regular expression, which can only follow an opening
+			// parenthesis or an operator ending in `=`; elsewhere, a slash
+			// divides.
+			before := strings.TrimRight(l.input[l.pos:l.pos+i], " \t\n\r")
+			if strings.HasSuffix(before, "(") || strings.HasSuffix(before, "=") {
+				if n := regexLength(l.input[l.pos+i : l.end]); n > 0 {
+					i += n - 1
+				}
+			}
+		}
+	}
+	return l.errorf("unterminated expression %s", l.input[l.pos:l.end])
+}
 
-	// trim whitespace to ensure we don't get hanging space operators
-	input = strings.TrimSpace(input)
+// binaryOperators lists the operators of expressions, longest first.
+var binaryOperators = []string{"&&", "||", "$=", "^=", "<=", ">=", "!=", "*=", "~=", "=", "+", "-", "*", "/", "%", "<", ">"}
 
-	var tokens []*token
-	var start = 0
-	for start < len(input) {
-		token, new_value, err := lexNextToken(input[start:], scanners)
+func (l *lexer) expressionToken() *SyntaxError {
+	c := l.peek(0)
+	switch {
+	case isSpace(c):
+		l.skipSpace()
+	case c == '(' || c == ')':
+		l.advance(1)
+		l.emit(S_PAREN, string(c))
+	case c == '"':
+		value, err := l.quoted()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		l.emit(S_STRING, value)
+	case isDigit(c) || c == '-' && isDigit(l.peek(1)) && l.expectingOperand():
+		l.number()
+	case c == '/' && l.expectingOperand():
+		n := regexLength(l.input[l.pos:l.end])
+		if n < 0 {
+			return l.errorf("unterminated regular expression")
+		}
+		l.advance(n)
+		l.emit(S_REGEX, l.input[l.start:l.pos])
+	case c == ',':
+		l.advance(1)
+		l.emit(S_OPER, ",")
+	case c == '.':
+		path, err := l.path()
+		if err != nil {
+			return err
+		}
+		l.emit(S_PATH, path)
+	case isLetter(c):
+		i := 0
+		for isLetter(l.peek(i)) {
+			i++
+		}
+		// Function names may be hyphenated, but a hyphen is a minus sign
+		// anywhere else.
+		for l.peek(i) == '-' && isLetter(l.peek(i+1)) {
+			j := i + 1
+			for isLetter(l.peek(j)) {
+				j++
+			}
+			if _, ok := exprFunctions[l.input[l.pos:l.pos+j]]; !ok {
+				break
+			}
+			i = j
+		}
+		word := l.input[l.pos : l.pos+i]
+		l.advance(i)
+		switch word {
+		case "true", "false":
+			l.emit(S_BOOL, word == "true")
+		case "null":
+			l.emit(S_NIL, nil)
+		case "x":
+			l.emit(S_PVAR, word)
+		default:
+			if l.peek(0) != '(' {
+				return l.errorf("unexpected %q", word)
+			}
+			if _, ok := exprFunctions[word]; !ok {
+				return l.errorf("unknown function %s()", word)
+			}
+			l.emit(S_FUNCTION, word)
 		}
-		start = start + new_value
-		if token.typ != S_EMPTY {
-			tokens = append(
-				tokens,
-				token,
-			)
+	default:
+		for _, operator := range binaryOperators {
+			if strings.HasPrefix(l.input[l.pos:l.end], operator) {
+				l.advance(len(operator))
+				l.emit(S_BINOP, operator)
+				return nil
+			}
 		}
+		return l.unexpected()
 	}
-	logger.Print("Tokenization results: ", input)
-	if logger.Enabled {
-		for i, token := range tokens {
-			logger.Print("[", i, "] ", token)
+	return nil
+}
+
+// path consumes a path from the node being validated to another: `..`
+// for its parent, repeated as `../..` for further ancestors, and then
+// `/key`, or `.key` without any `..`, for a member, followed by `.key`
+// for members of members.
+func (l *lexer) path() (exprPath, *SyntaxError) {
+	var path exprPath
+	if strings.HasPrefix(l.input[l.pos:l.end], "..") {
+		l.advance(2)
+		path.levels = 1
+		for strings.HasPrefix(l.input[l.pos:l.end], "/..") {
+			l.advance(3)
+			path.levels++
+		}
+		// Otherwise, the slash divides.
+		if c := l.peek(1); l.peek(0) != '/' || !(c == '"' || c == '_' || c == '\\' || isLetter(c) || c >= utf8.RuneSelf) {
+			return path, nil
+		}
+	}
+	for {
+		l.advance(1)
+		key, ok := "", false
+		if l.peek(0) == '"' {
+			var err *SyntaxError
+			if key, err = l.quoted(); err != nil {
+				return path, err
+			}
+			ok = true
+		} else {
+			var glob bool
+			key, glob, ok = l.name()
+			ok = ok && !glob
+		}
+		if !ok {
+			return path, l.errorf("expected a key in path %s", l.input[l.start:l.pos])
+		}
+		path.keys = append(path.keys, key)
+		if l.peek(0) != '.' {
+			return path, nil
 		}
 	}
-	return tokens, nil
 }
 
-func getToken(typ tokenType, val string) token {
-	switch typ {
-	case S_IDENTIFIER, S_PCLASS:
-		return token{typ, val[1:]}
-	case S_PCLASS_FUNC, S_NTH_FUNC:
-		// we match trailing whitespace in S_PCLASS_FUNC and S_NTH_FUNC to ensure
-		// we don't get a space operator before the expression. So we must trim the
-		// matched whitespace here
-		return token{typ, strings.TrimSpace(val[1:])}
-	case S_QUOTED_IDENTIFIER:
-		return token{S_IDENTIFIER, val[2 : len(val)-1]}
-	case S_NIL:
-		return token{typ, nil}
-	case S_BOOL:
-		result, _ := strconv.ParseBool(val)
-		return token{typ, result}
-	case S_NUMBER:
-		result, _ := strconv.ParseInt(val, 10, 64)
-		return token{typ, result}
-	case S_EMPTY:
-		return token{typ, " "}
-	case S_FLOAT:
-		result, _ := strconv.ParseFloat(val, 32)
-		return token{typ, result}
-	case S_WORD:
-		return token{typ, val[1 : len(val)-1]}
-	case S_STRING:
-		return token{S_STRING, val[1 : len(val)-1]}
-	case S_OPER:
-		// If the operator is padded with whitespace, we match the whole string so we must
-		// trim leading and trailing whitespace.
-		inner := strings.TrimSpace(val)
-		if inner == "" {
-			// If we're left with an empty string, we want a space operator.
-			inner = " "
+// regexLength returns the length of the regular expression literal, a
+// pattern between slashes followed by flags, at the start of s, or -1 if
+// its closing slash is missing.  A backslash escapes the character after
+// it, slashes included.
+func regexLength(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '/':
+			for i++; i < len(s) && isLetter(s[i]); i++ {
+			}
+			return i
 		}
-		return token{S_OPER, inner}
-	default:
-		return token{typ, val}
 	}
+	return -1
+}
+
+// expectingOperand reports whether the next token of an expression must be
+// an operand, so that a minus sign is part of a number rather than a
+// subtraction.
+func (l *lexer) expectingOperand() bool {
+	if len(l.tokens) == 0 {
+		return true
+	}
+	last := l.tokens[len(l.tokens)-1]
+	return last.typ == S_BINOP || last.typ == S_OPER || last.typ == S_PAREN && last.val == "("
+}
+
+// number consumes a number, which is an int64 if it is an integer and a
+// float64 otherwise.
+func (l *lexer) number() {
+	i := 0
+	if l.peek(0) == '-' {
+		i++
+	}
+	for isDigit(l.peek(i)) {
+		i++
+	}
+	integer := true
+	if l.peek(i) == '.' {
+		integer = false
+		for i++; isDigit(l.peek(i)); i++ {
+		}
+	}
+	if c := l.peek(i); c == 'e' || c == 'E' {
+		j := i + 1
+		if c := l.peek(j); c == '+' || c == '-' {
+			j++
+		}
+		if isDigit(l.peek(j)) {
+			integer = false
+			for i = j; isDigit(l.peek(i)); i++ {
+			}
+		}
+	}
+	text := l.input[l.pos : l.pos+i]
+	l.advance(i)
+	if integer {
+		if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+			l.emit(S_NUMBER, value)
+			return
+		}
+	}
+	value, _ := strconv.ParseFloat(text, 64)
+	l.emit(S_NUMBER, value)
+}
+
+// getExpressionText returns the source text of the parenthesized
+// expression at the head of tokens, if there is one.
+func getExpressionText(tokens []*token) string {
+	if len(tokens) > 0 && tokens[0].typ == S_EXPR {
+		return tokens[0].val.(string)
+	}
+	return ""
 }
@@ -1,85 +1,91 @@
 package jsonselect
 
 import (
+	"context"
 	"fmt"
-	"github.com/coddingtonbear/go-simplejson"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 )
 
+// defaultLogger receives trace events from parsers that were not given a
+// logger of their own via WithLogger; it is nil (disabled) until
+// EnableLogger is called.
+var defaultLogger *slog.Logger
+
+// logHandler sends trace events to a parser's logger.  Every query works
+// on a copy of it, so that the step and recursion depth it annotates
+// events with are the query's own.
 type logHandler struct {
-	Enabled        bool
+	logger         *slog.Logger
 	recursionLevel int
-	prefixes       map[int]string
+	step           int
 }
 
-var logger = logHandler{false, 0, nil}
-var handler = log.New(os.Stderr, "jsonselect: ", 0)
-var recursionMarker = "⇢ "
-
-func (l *logHandler) formatPrefix(a ...interface{}) []interface{} {
-	var arguments []interface{}
-	arguments = append(
-		arguments,
-		strings.Repeat(recursionMarker, l.recursionLevel),
-	)
-	prefix, ok := l.prefixes[l.recursionLevel]
-	if ok {
-		arguments = append(
-			arguments,
-			prefix,
-		)
+func (l *logHandler) current() *slog.Logger {
+	if l.logger != nil {
+		return l.logger
 	}
-	arguments = append(
-		arguments,
-		a...,
-	)
-	return arguments
+	return defaultLogger
 }
 
-func (l *logHandler) Print(a ...interface{}) {
-	if logger.Enabled {
-		handler.Print(l.formatPrefix(a...)...)
-	}
+// Enabled reports whether trace events would be recorded; use it to guard
+// any work done only to build log attributes.
+func (l *logHandler) Enabled() bool {
+	current := l.current()
+	return current != nil && current.Enabled(context.Background(), slog.LevelDebug)
 }
 
-func (l *logHandler) Println(a ...interface{}) {
-	if logger.Enabled {
-		handler.Println(l.formatPrefix(a...)...)
+// Trace emits a debug-level record annotated with the current selector
+// step and recursion depth.
+func (l *logHandler) Trace(msg string, args ...interface{}) {
+	current := l.current()
+	if current == nil || !current.Enabled(context.Background(), slog.LevelDebug) {
+		return
 	}
+	args = append(args, slog.Int("step", l.step), slog.Int("depth", l.recursionLevel))
+	current.Debug(msg, args...)
 }
 
 func (l *logHandler) IncreaseDepth() {
-	if logger.Enabled {
-		l.recursionLevel++
-	}
+	l.recursionLevel++
 }
 
 func (l *logHandler) DecreaseDepth() {
-	if logger.Enabled {
-		l.recursionLevel--
-	}
+	l.recursionLevel--
 }
 
-func (l *logHandler) SetPrefix(prefix ...interface{}) {
-	if logger.Enabled {
-		l.prefixes[l.recursionLevel] = fmt.Sprint(prefix...)
-	}
+// EnableLogger sends trace events from every parser without a logger of
+// its own to os.Stderr as text records.
+func EnableLogger() {
+	defaultLogger = slog.New(
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	).With(slog.String("lib", "jsonselect"))
 }
 
-func (l *logHandler) ClearPrefix() {
-	if logger.Enabled {
-		l.prefixes[l.recursionLevel] = ""
-	}
+// LogValue renders a node as its JSON Pointer so that trace events can
+// identify it without dumping the whole value.
+func (n *jsonNode) LogValue() slog.Value {
+	return slog.StringValue(n.pointer())
 }
 
-func EnableLogger() {
-	logger.prefixes = make(map[int]string)
-	logger.Enabled = true
+// pointer returns the RFC 6901 JSON Pointer of the node relative to the
+// root of the document map it belongs to.
+func (n *jsonNode) pointer() string {
+	if n.parent == nil {
+		return ""
+	}
+	var segment string
+	if n.parent.typ == J_ARRAY {
+		segment = strconv.Itoa(int(n.idx) - 1)
+	} else {
+		segment = strings.NewReplacer("~", "~0", "/", "~1").Replace(n.parentKey())
+	}
+	return n.parent.pointer() + "/" + segment
 }
 
-func getFormattedNodeMap(nodes map[*simplejson.Json]*jsonNode) []string {
+func getFormattedNodeMap(nodes map[*jsonNode]*jsonNode) []string {
 	output := make([]*jsonNode, 0, len(nodes))
 	for _, val := range nodes {
 		output = append(output, val)
@@ -91,7 +97,7 @@ func getFormattedNodeArray(nodes []*jsonNode) []string {
 	var formatted []string
 	for _, node := range nodes {
 		if node != nil {
-			formatted = append(formatted, fmt.Sprint(*node))
+			formatted = append(formatted, node.pointer())
 		} else {
 			formatted = append(formatted, fmt.Sprint(nil))
 		}
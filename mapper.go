@@ -1,111 +1,446 @@
 package jsonselect
 
 import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
 	"github.com/coddingtonbear/go-simplejson"
 )
 
-type jsonType string
+// jsonType is the type tag of a node, or of an expression element.
+type jsonType uint8
 
 const (
-	J_STRING  jsonType = "string"
-	J_NUMBER  jsonType = "number"
-	J_OBJECT  jsonType = "object"
-	J_ARRAY   jsonType = "array"
-	J_BOOLEAN jsonType = "boolean"
-	J_NULL    jsonType = "null"
+	J_STRING jsonType = iota + 1
+	J_NUMBER
+	J_OBJECT
+	J_ARRAY
+	J_BOOLEAN
+	J_NULL
 
 	// Not actually a type, obviously
-	J_OPER jsonType = "oper"
+	J_OPER
 )
 
+var jsonTypeNames = [...]string{"", "string", "number", "object", "array", "boolean", "null", "oper"}
+
+func (t jsonType) String() string {
+	if int(t) < len(jsonTypeNames) {
+		return jsonTypeNames[t]
+	}
+	return ""
+}
+
+// getJsonType returns the type named by a type selector such as `object`,
+// or zero if there is no such type.
+func getJsonType(name string) jsonType {
+	for i, typeName := range jsonTypeNames[J_STRING:J_OPER] {
+		if typeName == name {
+			return jsonType(i) + J_STRING
+		}
+	}
+	return 0
+}
+
+// jsonNode is a single value of the document.  All of a document's nodes
+// are allocated together in one arena, in post-order, and refer to the
+// decoded document rather than copying it: strings, arrays and objects
+// share its memory, numbers are kept in a single slab for the document and
+// keys are interned, which leaves 48 bytes per node.
 type jsonNode struct {
-	value      interface{}
-	typ        jsonType
-	json       *simplejson.Json
-	parent     *jsonNode
-	parent_key string
-	idx        int
-	siblings   int
+	parent *jsonNode
+	// payload is the value of a string, boolean, array or object, or
+	// points to the value of a number.
+	payload interface{}
+	// name is the key of an object member, shared with every other member
+	// of the document with the same key, or nil.
+	name *string
+	// idx is the one-based position of an array element, or zero.
+	idx int32
+	// post is the node's post-order number, its position in the document
+	// map.  descendants is the size of its subtree, not counting itself,
+	// which occupies the positions just before it.
+	post        int32
+	descendants int32
+	// depth is the number of ancestors the node has; encoding/json refuses
+	// to decode documents nested anywhere near as deeply as it can count.
+	depth uint16
+	typ   jsonType
 }
 
-func (p *Parser) getFlooredDocumentMap(node *jsonNode) []*jsonNode {
-	var newMap []*jsonNode
-	newMap = p.findSubordinatejsonNodes(node.json, newMap, nil, "", -1, -1)
+// value returns the node's value as decoded by encoding/json, with numbers
+// as float64.
+func (n *jsonNode) value() interface{} {
+	if n.typ == J_NUMBER {
+		return *n.payload.(*float64)
+	}
+	return n.payload
+}
 
-	if logger.Enabled {
-		logger.Print("Floored document map for ", node, " reduced node count to ", len(newMap))
+// pre returns the node's pre-order number; a node is a descendant of
+// another exactly when its pre number is greater and its post number
+// smaller.  The nodes before its subtree in the map precede it in
+// pre-order too, and so do its ancestors, which follow it in the map.
+func (n *jsonNode) pre() int32 {
+	return n.post - n.descendants + int32(n.depth)
+}
+
+// parentKey returns the key of an object member, or "" for other nodes.
+func (n *jsonNode) parentKey() string {
+	if n.name == nil {
+		return ""
 	}
+	return *n.name
+}
 
-	return newMap
+// siblings returns the number of elements of the array holding the node,
+// or zero if it is not an array element.
+func (n *jsonNode) siblings() int32 {
+	if n.parent == nil || n.parent.typ != J_ARRAY {
+		return 0
+	}
+	return int32(len(n.parent.payload.([]interface{})))
+}
+
+// documentStats summarizes the shape of a document for the planner.
+type documentStats struct {
+	averageDepth    float64
+	averageChildren float64
 }
 
-func (p *Parser) findSubordinatejsonNodes(jdoc *simplejson.Json, nodes []*jsonNode, parent *jsonNode, parent_key string, idx int, siblings int) []*jsonNode {
-	node := jsonNode{}
-	node.parent = parent
-	node.json = jdoc
-	if len(parent_key) > 0 {
-		node.parent_key = parent_key
+// countNodes returns the number of nodes a decoded value maps to, how many
+// of them are numbers, and whether the order of the members of any of its
+// objects matters, which is when one has several.
+func countNodes(data interface{}) (count int, numbers int, ordered bool) {
+	switch value := data.(type) {
+	case []interface{}:
+		count = 1
+		for _, element := range value {
+			c, n, o := countNodes(element)
+			count, numbers, ordered = count+c, numbers+n, ordered || o
+		}
+	case map[string]interface{}:
+		count, ordered = 1, len(value) > 1
+		for _, element := range value {
+			c, n, o := countNodes(element)
+			count, numbers, ordered = count+c, numbers+n, ordered || o
+		}
+	case string, bool, nil:
+		count = 1
+	default:
+		count, numbers = 1, 1
 	}
-	if idx > -1 {
-		node.idx = idx
+	return count, numbers, ordered
+}
+
+// keyOrder records the order in which the members of objects appear in the
+// text of a document, which decoding it into maps loses.  keys holds the
+// key of every member in document order, each followed by the keys within
+// its value, just as mapping the document visits them; members holds the
+// number of members of each object, in the same order.
+type keyOrder struct {
+	text    []byte
+	keys    []keySpan
+	members []int32
+	// escaped holds the keys that had to be unescaped.
+	escaped [][]byte
+	// key and object are how many keys and objects mapping has consumed.
+	// broken is set if the text turns out not to match the document.
+	key    int
+	object int
+	broken bool
+}
+
+// keySpan locates a key within the text of a document, or if start is
+// negative, at -start-1 among the keys that had to be unescaped.
+type keySpan struct {
+	start int32
+	end   int32
+}
+
+// scanKeyOrder returns the key order of the document in body, which maps to
+// count nodes, or nil if it cannot be scanned.
+func scanKeyOrder(body []byte, count int) *keyOrder {
+	// Every node but the root is either a member of an object or an element
+	// of an array.
+	order := &keyOrder{text: body, keys: make([]keySpan, 0, count-1)}
+	// open holds, for each container the scan is within, the index of its
+	// member count if it is an object, or -1.
+	var open []int
+	_, err := ScanValues(body, func(frames []RawFrame) bool {
+		frame := &frames[len(frames)-1]
+		open = open[:len(frames)-1]
+		if len(open) > 0 && open[len(open)-1] >= 0 {
+			// The quoted key is a slice of body, so its offset follows from
+			// their capacities.
+			start := cap(body) - cap(frame.key) + 1
+			span := keySpan{int32(start), int32(start + len(frame.key) - 2)}
+			if frame.escaped {
+				var unescaped string
+				json.Unmarshal(frame.key, &unescaped)
+				span = keySpan{int32(-len(order.escaped) - 1), 0}
+				order.escaped = append(order.escaped, []byte(unescaped))
+			}
+			order.keys = append(order.keys, span)
+			order.members[open[len(open)-1]]++
+		}
+		if frame.typ == J_OBJECT {
+			open = append(open, len(order.members))
+			order.members = append(order.members, 0)
+		} else {
+			open = append(open, -1)
+		}
+		return false
+	})
+	if err != nil {
+		return nil
 	}
-	if siblings > -1 {
-		node.siblings = siblings
+	return order
+}
+
+// enter moves on to the next object mapping reaches, which has n members,
+// reporting false if the text holds a different number of members, as it
+// does when keys are duplicated.
+func (o *keyOrder) enter(n int) bool {
+	if o.broken || o.object >= len(o.members) || int(o.members[o.object]) != n {
+		return false
 	}
+	o.object++
+	return true
+}
 
-	string_value, err := jdoc.String()
-	if err == nil {
-		node.value = string_value
-		node.typ = J_STRING
+// member returns the key of the next member mapping reaches.
+func (o *keyOrder) member() []byte {
+	if o.key >= len(o.keys) {
+		o.broken = true
+		return nil
 	}
+	span := o.keys[o.key]
+	o.key++
+	if span.start < 0 {
+		return o.escaped[-span.start-1]
+	}
+	return o.text[span.start:span.end]
+}
 
-	int_value, err := jdoc.Int()
-	if err == nil {
-		node.value = int_value
-		node.typ = J_NUMBER
+// documentMapper holds the state of mapping a document into its arena.
+type documentMapper struct {
+	nodes []jsonNode
+	// order is the order of the members of objects in the text of the
+	// document, if it is known.
+	order *keyOrder
+	// numbers holds the values of the document's numbers.
+	numbers []float64
+	// names holds the keys met so far, each made a string only once.
+	names map[string]*string
+	// sortedKeys holds the keys of the objects being mapped when their
+	// order in the document is unknown.
+	sortedKeys []string
+}
+
+// intern returns the copy of key shared by every member named key.
+func (d *documentMapper) intern(key string) *string {
+	name, ok := d.names[key]
+	if !ok {
+		name = new(string)
+		*name = key
+		d.names[key] = name
 	}
+	return name
+}
+
+// number stores the value of a number in the slab, which is allocated for
+// all of them at once.
+func (d *documentMapper) number(value float64) *float64 {
+	d.numbers = append(d.numbers, value)
+	return &d.numbers[len(d.numbers)-1]
+}
+
+// findSubordinatejsonNodes maps data and everything below it.  Nodes are
+// appended to the arena once all of their children have been, so that the
+// length of the arena so far is a node's post-order number, and only then
+// made the parent of their children.
+func (d *documentMapper) findSubordinatejsonNodes(data interface{}, name *string, idx int, depth int) {
+	node := jsonNode{name: name, idx: int32(idx), depth: uint16(depth)}
+	first := len(d.nodes)
 
-	float_value, err := jdoc.Float64()
-	if err == nil {
-		node.value = float_value
+	// Store data itself rather than the typed value, which would have to
+	// be boxed again.
+	switch value := data.(type) {
+	case string:
+		node.payload = data
+		node.typ = J_STRING
+	case json.Number:
+		number, _ := value.Float64()
+		node.payload = d.number(number)
+		node.typ = J_NUMBER
+	case float64:
+		node.payload = d.number(value)
 		node.typ = J_NUMBER
+	case bool:
+		node.payload = data
+		node.typ = J_BOOLEAN
+	case nil:
+		node.typ = J_NULL
+	case []interface{}:
+		node.payload = data
+		node.typ = J_ARRAY
+		for i, element := range value {
+			d.findSubordinatejsonNodes(element, nil, i+1, depth+1)
+		}
+	case map[string]interface{}:
+		node.payload = data
+		node.typ = J_OBJECT
+		// Members are mapped in document order, so that the order of their
+		// pre-order numbers is that of the document.
+		if d.order != nil {
+			if !d.order.enter(len(value)) {
+				d.order.broken = true
+				break
+			}
+			for i := 0; i < len(value) && !d.order.broken; i++ {
+				key := d.order.member()
+				name, ok := d.names[string(key)]
+				if !ok {
+					name = d.intern(string(key))
+				}
+				element, ok := value[*name]
+				if !ok {
+					d.order.broken = true
+					break
+				}
+				d.findSubordinatejsonNodes(element, name, 0, depth+1)
+			}
+			break
+		}
+		// Without one, they are mapped in key order, sorting the keys on
+		// top of those of the enclosing objects.
+		start := len(d.sortedKeys)
+		for key := range value {
+			d.sortedKeys = append(d.sortedKeys, key)
+		}
+		sort.Strings(d.sortedKeys[start:])
+		for i := start; i < start+len(value); i++ {
+			key := d.sortedKeys[i]
+			d.findSubordinatejsonNodes(value[key], d.intern(key), 0, depth+1)
+		}
+		d.sortedKeys = d.sortedKeys[:start]
+	default:
+		// Documents built in code may hold any Go numeric type.
+		number := reflect.ValueOf(data)
+		switch {
+		case number.CanFloat():
+			node.payload = d.number(number.Float())
+			node.typ = J_NUMBER
+		case number.CanInt():
+			node.payload = d.number(float64(number.Int()))
+			node.typ = J_NUMBER
+		case number.CanUint():
+			node.payload = d.number(float64(number.Uint()))
+			node.typ = J_NUMBER
+		}
 	}
 
-	bool_value, err := jdoc.Bool()
-	if err == nil {
-		node.value = bool_value
-		node.typ = J_BOOLEAN
+	node.post = int32(len(d.nodes))
+	node.descendants = int32(len(d.nodes) - first)
+	// The arena was made large enough for every node, so appending never
+	// moves the nodes already in place.
+	d.nodes = append(d.nodes, node)
+	for i := node.post - 1; i >= int32(first); i -= d.nodes[i].descendants + 1 {
+		d.nodes[i].parent = &d.nodes[node.post]
 	}
+}
 
-	if jdoc.IsNil() {
-		node.value = nil
-		node.typ = J_NULL
+// mapDocument maps the parser's document, whose text is source if it is
+// known.  The members of objects are placed in the order of the text, which
+// is only scanned for if an object has several, and otherwise in key
+// order.
+func (p *Parser) mapDocument(source []byte) {
+	data := p.Data.Interface()
+	count, numbers, ordered := countNodes(data)
+	d := &documentMapper{
+		nodes:   make([]jsonNode, 0, count),
+		numbers: make([]float64, 0, numbers),
+		names:   make(map[string]*string),
+	}
+	if source != nil && ordered {
+		d.order = scanKeyOrder(source, count)
+	}
+	d.findSubordinatejsonNodes(data, nil, 0, 0)
+	if d.order != nil && d.order.broken {
+		// Keys are duplicated; fall back to key order throughout.
+		d.nodes, d.numbers, d.order = d.nodes[:0], d.numbers[:0], nil
+		d.findSubordinatejsonNodes(data, nil, 0, 0)
 	}
+	p.nodes = d.nodes
 
-	length, err := jdoc.ArrayLength()
-	if err == nil {
-		node.value, _ = jdoc.Array()
-		node.typ = J_ARRAY
-		for i := 0; i < length; i++ {
-			element := jdoc.GetIndex(i)
-			nodes = p.findSubordinatejsonNodes(element, nodes, &node, "", i+1, length)
+	var depths, containers int
+	for i := range p.nodes {
+		depths += int(p.nodes[i].depth)
+		if nodeHasChildren(&p.nodes[i]) {
+			containers++
 		}
 	}
-	data, err := jdoc.Map()
-	if err == nil {
-		node.value, _ = jdoc.Map()
-		node.typ = J_OBJECT
-		for key := range data {
-			element := jdoc.Get(key)
-			nodes = p.findSubordinatejsonNodes(element, nodes, &node, key, -1, -1)
+	p.stats.averageDepth = float64(depths) / float64(len(p.nodes))
+	if containers > 0 {
+		// Every node but the root is some container's child.
+		p.stats.averageChildren = float64(len(p.nodes)-1) / float64(containers)
+	}
+}
+
+// nodeAtPointer returns the node addressed by an RFC 6901 JSON Pointer, or
+// nil if the document has no such node.
+func (p *Parser) nodeAtPointer(pointer string) *jsonNode {
+	for i := range p.nodes {
+		if p.nodes[i].pointer() == pointer {
+			return &p.nodes[i]
 		}
 	}
+	return nil
+}
 
-	nodes = append(nodes, &node)
-	return nodes
+// children returns the direct children of a node of the document map, in
+// document order.  Each child's subtree immediately precedes the next, so
+// they can be found by stepping backwards over whole subtrees.
+func (p *Parser) children(node *jsonNode) []*jsonNode {
+	var count int
+	switch value := node.payload.(type) {
+	case []interface{}:
+		count = len(value)
+	case map[string]interface{}:
+		count = len(value)
+	}
+	children := make([]*jsonNode, 0, count)
+	for i := node.post - 1; i >= node.post-node.descendants; i -= p.nodes[i].descendants + 1 {
+		children = append(children, &p.nodes[i])
+	}
+	for i, j := 0, len(children)-1; i < j; i, j = i+1, j-1 {
+		children[i], children[j] = children[j], children[i]
+	}
+	return children
+}
+
+// previousSibling returns the member or element preceding node in its
+// parent, or nil if it is the first.  Its subtree ends just before node's
+// begins.
+func (p *Parser) previousSibling(node *jsonNode) *jsonNode {
+	i := node.post - node.descendants - 1
+	if node.parent == nil || i < 0 || p.nodes[i].parent != node.parent {
+		return nil
+	}
+	return &p.nodes[i]
 }
 
-func (p *Parser) mapDocument() {
-	var nodes []*jsonNode
-	p.nodes = p.findSubordinatejsonNodes(p.Data, nodes, nil, "", -1, -1)
+// getJsonElement returns node as a *simplejson.Json, found by descending
+// from the root of the document.
+func (p *Parser) getJsonElement(node *jsonNode) *simplejson.Json {
+	if node.parent == nil {
+		return p.Data
+	}
+	parent := p.getJsonElement(node.parent)
+	if node.parent.typ == J_ARRAY {
+		return parent.GetIndex(int(node.idx) - 1)
+	}
+	return parent.Get(node.parentKey())
 }
@@ -0,0 +1,365 @@
+package jsonselect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Evaluation strategies a plan can choose for a step.
+const (
+	// StrategyScan applies the step's validators to each of its candidate
+	// nodes and joins the matches with the rest of the selector.
+	StrategyScan = "scan"
+	// StrategyProbe applies the step's validators only to the ancestors,
+	// parents or siblings of the nodes already selected by the rest of the
+	// selector, never examining the rest of the document.
+	StrategyProbe = "probe"
+)
+
+// Plan describes how a selector is evaluated.  Steps are listed in the
+// order they appear in the selector, but evaluated from the rightmost one
+// leftwards: the rightmost step selects the nodes that can be returned,
+// and every step to its left only filters those.
+type Plan struct {
+	Selector string      `json:"selector"`
+	Steps    []*PlanStep `json:"steps"`
+}
+
+// PlanStep describes the evaluation of a single compound selector.
+type PlanStep struct {
+	Selector string `json:"selector"`
+	// Validators lists the step's components in the order they are
+	// applied, cheapest first.
+	Validators []string `json:"validators"`
+	Combinator string   `json:"combinator,omitempty"`
+	Strategy   string   `json:"strategy"`
+	// Candidates is the number of nodes a scan would examine; it is smaller
+	// than the document when an index narrows the step down.
+	Candidates int  `json:"candidates"`
+	Indexed    bool `json:"indexed"`
+	// Estimate is the expected number of nodes handed back by this step
+	// once the rest of the selector has been applied, and Cost the
+	// expected number of validator calls the chosen strategy makes.
+	Estimate float64 `json:"estimate"`
+	Cost     float64 `json:"cost"`
+}
+
+func (pl *Plan) String() string {
+	var lines []string
+	for i, step := range pl.Steps {
+		line := fmt.Sprintf("%d. %s %s [%s]", i+1, step.Strategy, step.Selector, strings.Join(step.Validators, " "))
+		if step.Indexed {
+			line += fmt.Sprintf(" from %d indexed candidates", step.Candidates)
+		}
+		line += fmt.Sprintf(" est=%.2g cost=%.2g", step.Estimate, step.Cost)
+		if step.Combinator != "" {
+			line += fmt.Sprintf(" then `%s`", step.Combinator)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// selectorStep is one compound selector of a program together with the
+// combinator joining it to the next one, which is empty for the last.
+type selectorStep struct {
+	compound   string
+	validators []validator
+	operator   string
+
+	// Set by planSelector.
+	plan *PlanStep
+	// candidates lists the nodes an index narrowed the step down to, if
+	// one did.
+	candidates []*jsonNode
+}
+
+// validatorCost ranks validators by how expensive they are to apply.
+func validatorCost(v validator) int {
+	switch {
+	case v.kind == S_NTH_FUNC, v.kind == S_KEY_PATTERN:
+		return 2
+	case v.kind == S_PARENT:
+		return 5
+	case v.kind != S_PCLASS_FUNC:
+		return 1
+	case strings.HasPrefix(v.name, ":has"):
+		return 5
+	case strings.HasPrefix(v.name, ":expr"):
+		return 4
+	}
+	return 3
+}
+
+// validatorSelectivity guesses the fraction of nodes a validator accepts.
+func (p *Parser) validatorSelectivity(v validator) float64 {
+	switch {
+	case v.kind == S_IDENTIFIER:
+		return 0.05
+	case v.kind == S_KEY_PATTERN, strings.HasPrefix(v.name, ":key"):
+		return 0.1
+	case v.kind == S_TYPE:
+		return 0.3
+	case v.kind == S_OPER:
+		return 1
+	case v.name == ":root", v.name == ":scope":
+		return 1 / float64(len(p.nodes))
+	case strings.HasPrefix(v.name, ":val"):
+		return 0.05
+	case strings.HasPrefix(v.name, ":expr"):
+		return 0.5
+	case strings.HasPrefix(v.name, ":not"):
+		return 0.8
+	}
+	return 0.2
+}
+
+// Plan returns the plan the parser would follow to evaluate selector,
+// without evaluating it.
+func (p *Parser) Plan(selector string) (*Plan, error) {
+	program, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return p.planSelector(selector, program.steps()), nil
+}
+
+// planSelector chooses a strategy for every step, working leftwards from
+// the last one.  A step joined to the rest of the selector by a combinator
+// is probed when checking the relatives of the nodes estimated to reach it
+// is cheaper than scanning its candidates.
+func (p *Parser) planSelector(selector string, steps []*selectorStep) *Plan {
+	plan := &Plan{Selector: selector, Steps: make([]*PlanStep, len(steps))}
+	total := float64(len(p.nodes))
+	var rest float64
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		var source int
+		step.candidates, source = p.candidates(step.validators)
+		step.plan = &PlanStep{
+			Selector:   step.compound,
+			Combinator: step.operator,
+			Strategy:   StrategyScan,
+			Candidates: len(p.nodes),
+			Indexed:    source >= 0,
+		}
+		if step.plan.Indexed {
+			step.plan.Candidates = len(step.candidates)
+		}
+		for _, validator := range step.validators {
+			step.plan.Validators = append(step.plan.Validators, validator.name)
+		}
+		plan.Steps[i] = step.plan
+
+		matches := float64(step.plan.Candidates)
+		for j, validator := range step.validators {
+			if j != source {
+				matches *= p.validatorSelectivity(validator)
+			}
+		}
+		applications := float64(len(step.validators))
+		scanCost := float64(step.plan.Candidates) * applications
+
+		var relatives float64
+		switch step.operator {
+		case "":
+			step.plan.Estimate, step.plan.Cost = matches, scanCost
+			rest = matches
+			continue
+		case ",":
+			step.plan.Estimate, step.plan.Cost = matches+rest, scanCost
+			rest += matches
+			continue
+		case " ":
+			// Probing memoizes ancestors, so it never costs more than
+			// visiting every node once.
+			relatives = p.stats.averageDepth + 1
+		case ">":
+			relatives = 1
+		case "~":
+			relatives = p.stats.averageChildren
+		case "+":
+			relatives = 1
+		}
+		probeCost := rest * relatives * applications
+		if probeCost > total*applications {
+			probeCost = total * applications
+		}
+		if probeCost < scanCost {
+			step.plan.Strategy = StrategyProbe
+			step.plan.Cost = probeCost
+		} else {
+			step.plan.Cost = scanCost
+		}
+		if fraction := matches / total * relatives; fraction < 1 {
+			rest *= fraction
+		}
+		step.plan.Estimate = rest
+	}
+	return plan
+}
+
+// executeStep evaluates steps[i:], returning the nodes they select.
+func (p *Parser) executeStep(m *machine, steps []*selectorStep, i int) ([]*jsonNode, error) {
+	step := steps[i]
+	span := m.profileStart("step", step.compound, 0)
+	defer m.profileEnd(span)
+	m.log.step = i + 1
+	m.log.Trace("step starting", "compound", step.compound, "strategy", step.plan.Strategy, "combinator", step.operator)
+
+	trace := m.traceStep(i+1, step.compound, step.validators, 0)
+	if trace != nil {
+		trace.Strategy = step.plan.Strategy
+	}
+
+	var results []*jsonNode
+	if step.operator == "" || step.operator == "," {
+		results = p.scanStep(m, step, trace)
+	}
+	if step.operator != "" {
+		m.log.IncreaseDepth()
+		m.traceDescend(trace)
+		rvals, err := p.executeStep(m, steps, i+1)
+		m.log.DecreaseDepth()
+		m.log.step = i + 1
+		if err != nil {
+			return nil, err
+		}
+		m.log.Trace("step recursion completed", "combinator", step.operator, "matches", len(rvals))
+
+		if step.plan.Strategy == StrategyProbe {
+			results = p.probeStep(m, step, rvals, trace)
+			if trace != nil {
+				traceCombinator(trace, step.operator, trace.Matched, len(rvals), len(results))
+			}
+		} else {
+			if step.operator != "," {
+				results = p.scanStep(m, step, trace)
+			}
+			originalLength := len(results)
+			combinatorSpan := m.profileStart("combinator", step.operator, len(results)+len(rvals))
+			switch step.operator {
+			case ",":
+				results = append(results, rvals...)
+			case ">":
+				results = parents(results, rvals)
+			case "~":
+				results = siblings(results, rvals)
+			case "+":
+				results = p.adjacent(results, rvals)
+			case " ":
+				results = ancestors(results, rvals)
+			}
+			m.profileEnd(combinatorSpan)
+			m.log.Trace("combinator applied", "combinator", step.operator, "lhs", originalLength, "rhs", len(rvals), "matches", len(results))
+			traceCombinator(trace, step.operator, originalLength, len(rvals), len(results))
+		}
+	}
+
+	m.log.Trace("step returning", "matches", len(results))
+	if trace != nil {
+		trace.Results = len(results)
+		trace.results = results
+	}
+	return results, nil
+}
+
+// scanStep applies the step's validators to each of its candidates.
+func (p *Parser) scanStep(m *machine, step *selectorStep, trace *TraceStep) []*jsonNode {
+	span := m.profileStart("matchNodes", step.compound, step.plan.Candidates)
+	var results []*jsonNode
+	if step.plan.Indexed {
+		results = p.matchNodes(m, step.validators, step.candidates, trace)
+	} else {
+		results = p.matchDocument(m, step.validators, trace)
+	}
+	m.profileEnd(span)
+	m.log.Trace("validators applied", "validators", len(step.validators), "nodes", step.plan.Candidates, "matches", len(results))
+	if trace != nil {
+		trace.Nodes = step.plan.Candidates
+		trace.Matched = len(results)
+		trace.matched = results
+	}
+	return results
+}
+
+// probeStep keeps the nodes of rhs related by the step's combinator to a
+// node accepted by the step's validators, checking only those relatives.
+func (p *Parser) probeStep(m *machine, step *selectorStep, rhs []*jsonNode, trace *TraceStep) []*jsonNode {
+	span := m.profileStart("probe", step.compound, len(rhs))
+	defer m.profileEnd(span)
+
+	probes, accepted := 0, 0
+	probe := func(node *jsonNode) bool {
+		probes++
+		if p.nodeMatches(m, step.validators, node, trace) {
+			accepted++
+			return true
+		}
+		return false
+	}
+	// Results of probing a node's ancestors (for ` `), keyed by post-order
+	// number, as many nodes of rhs usually share them.
+	memo := make(map[int32]bool)
+	// The pre-order number of the first of a parent's children accepted
+	// (for `~`), or -1 if none is, keyed by the parent's post-order number.
+	first := make(map[int32]int32)
+
+	var results []*jsonNode
+	for _, node := range rhs {
+		var matched bool
+		switch step.operator {
+		case " ":
+			var path []*jsonNode
+			ancestor := node
+			for ; ancestor != nil; ancestor = ancestor.parent {
+				if known, ok := memo[ancestor.post]; ok {
+					matched = known
+					break
+				}
+				path = append(path, ancestor)
+				if probe(ancestor) {
+					matched = true
+					break
+				}
+			}
+			for _, visited := range path {
+				memo[visited.post] = matched
+			}
+		case ">":
+			matched = node.parent != nil && probe(node.parent)
+		case "~":
+			if node.parent == nil {
+				break
+			}
+			pre, ok := first[node.parent.post]
+			if !ok {
+				pre = -1
+				for _, sibling := range p.children(node.parent) {
+					if probe(sibling) {
+						pre = sibling.pre()
+						break
+					}
+				}
+				first[node.parent.post] = pre
+			}
+			matched = pre >= 0 && pre < node.pre()
+		case "+":
+			previous := p.previousSibling(node)
+			matched = previous != nil && probe(previous)
+		}
+		if matched {
+			results = append(results, node)
+		}
+	}
+
+	if span != nil {
+		span.nodes = probes
+	}
+	m.log.Trace("relatives probed", "combinator", step.operator, "rhs", len(rhs), "probes", probes, "matches", len(results))
+	if trace != nil {
+		trace.Nodes = probes
+		trace.Matched = accepted
+	}
+	return results
+}
@@ -0,0 +1,207 @@
+package jsonselect
+
+import (
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Profiler accumulates the cost of evaluating selectors, broken down by
+// selector step, node matching pass, combinator and pseudo-class.  Attach
+// one to any number of parsers with WithProfiler.
+type Profiler struct {
+	mu      sync.Mutex
+	entries map[profileKey]*ProfileEntry
+}
+
+// ProfileReport lists profiler entries, most expensive first; it can be
+// serialized with encoding/json.
+type ProfileReport struct {
+	Entries []ProfileEntry `json:"entries"`
+}
+
+// ProfileEntry aggregates every measurement taken for one kind of work
+// (e.g. "matchNodes") on one part of a selector (e.g. ".rating").  Self
+// figures exclude time and allocations spent in nested measurements.
+//
+// Only selector steps, node matching passes and combinators are measured:
+// allocation counts are sampled from runtime/metrics when each of them
+// starts and ends, and are approximate.  `:has` and `:expr`, which are
+// evaluated once per node, are only counted; their entries give the
+// number of evaluations and of nodes they visited, and their cost is part
+// of the self figures of the pass that evaluated them.
+type ProfileEntry struct {
+	Kind           string        `json:"kind"`
+	Selector       string        `json:"selector"`
+	Calls          int           `json:"calls"`
+	WallTime       time.Duration `json:"wallTimeNs"`
+	SelfTime       time.Duration `json:"selfTimeNs"`
+	Nodes          int           `json:"nodes"`
+	Allocations    uint64        `json:"allocations"`
+	AllocatedBytes uint64        `json:"allocatedBytes"`
+}
+
+type profileKey struct {
+	kind     string
+	selector string
+}
+
+type profileSpan struct {
+	key         profileKey
+	nodes       int
+	start       time.Time
+	allocs      uint64
+	bytes       uint64
+	childTime   time.Duration
+	childAllocs uint64
+	childBytes  uint64
+}
+
+// profileState holds the spans currently open for a single query, and the
+// per node evaluations it has counted so far.
+type profileState struct {
+	profiler *Profiler
+	stack    []*profileSpan
+	samples  []metrics.Sample
+	counts   map[profileKey]*ProfileEntry
+}
+
+// NewProfiler returns an empty profiler.  It is safe for concurrent use, so
+// several parsers may share one and have their costs added up together.
+func NewProfiler() *Profiler {
+	return &Profiler{entries: make(map[profileKey]*ProfileEntry)}
+}
+
+// WithProfiler records the cost of every selector the parser evaluates
+// into profiler.
+func WithProfiler(profiler *Profiler) Option {
+	return func(p *Parser) {
+		p.profile = profiler
+	}
+}
+
+func newProfileState(profiler *Profiler) *profileState {
+	return &profileState{
+		profiler: profiler,
+		samples: []metrics.Sample{
+			{Name: "/gc/heap/allocs:objects"},
+			{Name: "/gc/heap/allocs:bytes"},
+		},
+	}
+}
+
+// Report returns the entries recorded so far, sorted by self time.
+func (pr *Profiler) Report() *ProfileReport {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	report := &ProfileReport{Entries: make([]ProfileEntry, 0, len(pr.entries))}
+	for _, entry := range pr.entries {
+		report.Entries = append(report.Entries, *entry)
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		if report.Entries[i].SelfTime != report.Entries[j].SelfTime {
+			return report.Entries[i].SelfTime > report.Entries[j].SelfTime
+		}
+		return report.Entries[i].WallTime > report.Entries[j].WallTime
+	})
+	return report
+}
+
+// Reset discards every entry recorded so far.
+func (pr *Profiler) Reset() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.entries = make(map[profileKey]*ProfileEntry)
+}
+
+func (pr *Profiler) record(span *profileSpan, wall time.Duration, allocs uint64, bytes uint64) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	entry, ok := pr.entries[span.key]
+	if !ok {
+		entry = &ProfileEntry{Kind: span.key.kind, Selector: span.key.selector}
+		pr.entries[span.key] = entry
+	}
+	entry.Calls++
+	entry.WallTime += wall
+	entry.SelfTime += wall - span.childTime
+	entry.Nodes += span.nodes
+	entry.Allocations += allocs - span.childAllocs
+	entry.AllocatedBytes += bytes - span.childBytes
+}
+
+// flush adds the evaluations counted during the query to the profiler.
+func (pr *Profiler) flush(counts map[profileKey]*ProfileEntry) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for key, count := range counts {
+		entry, ok := pr.entries[key]
+		if !ok {
+			entry = &ProfileEntry{Kind: key.kind, Selector: key.selector}
+			pr.entries[key] = entry
+		}
+		entry.Calls += count.Calls
+		entry.Nodes += count.Nodes
+	}
+}
+
+func (s *profileState) readAllocations() (uint64, uint64) {
+	metrics.Read(s.samples)
+	return s.samples[0].Value.Uint64(), s.samples[1].Value.Uint64()
+}
+
+// profileStart opens a measurement of the given kind of work; it returns
+// nil when the query is not profiled.
+func (m *machine) profileStart(kind string, selector string, nodes int) *profileSpan {
+	if m.profile == nil {
+		return nil
+	}
+	span := &profileSpan{key: profileKey{kind, selector}, nodes: nodes}
+	span.allocs, span.bytes = m.profile.readAllocations()
+	m.profile.stack = append(m.profile.stack, span)
+	span.start = time.Now()
+	return span
+}
+
+func (m *machine) profileEnd(span *profileSpan) {
+	if span == nil {
+		return
+	}
+	wall := time.Since(span.start)
+	allocs, bytes := m.profile.readAllocations()
+	allocs, bytes = allocs-span.allocs, bytes-span.bytes
+
+	stack := m.profile.stack
+	m.profile.stack = stack[:len(stack)-1]
+	if len(m.profile.stack) > 0 {
+		parent := m.profile.stack[len(m.profile.stack)-1]
+		parent.childTime += wall
+		parent.childAllocs += allocs
+		parent.childBytes += bytes
+	}
+	m.profile.profiler.record(span, wall, allocs, bytes)
+}
+
+// profileCount counts an evaluation of kind for a single node, having
+// visited nodes nodes; the counts are added to the profiler when the query
+// ends, and the evaluation itself is not measured.
+func (m *machine) profileCount(kind string, selector string, nodes int) {
+	if m.profile == nil {
+		return
+	}
+	key := profileKey{kind, selector}
+	count, ok := m.profile.counts[key]
+	if !ok {
+		if m.profile.counts == nil {
+			m.profile.counts = make(map[profileKey]*ProfileEntry)
+		}
+		count = &ProfileEntry{}
+		m.profile.counts[key] = count
+	}
+	count.Calls++
+	count.Nodes += nodes
+}
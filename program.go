@@ -0,0 +1,649 @@
+package jsonselect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+)
+
+type opcode uint8
+
+// The instruction set of compiled selectors.  A selector is a sequence of
+// steps, each a STEP followed by its validators and then the join to the
+// next step, or END after the last one.  A validator is a VALIDATOR
+// followed by the predicates a node must satisfy to be accepted by it.
+const (
+	// OP_STEP starts a compound selector; a is its text.
+	OP_STEP opcode = iota
+	// OP_VALIDATOR starts a validator; a is its name and b its kind.
+	OP_VALIDATOR
+	// Joins between steps, and the end of a selector.
+	OP_DESCENDANT
+	OP_CHILD
+	OP_SIBLING
+	OP_ADJACENT
+	OP_UNION
+	OP_END
+
+	// OP_TYPE accepts nodes of type a.
+	OP_TYPE
+	// OP_KEY accepts object members named a.
+	OP_KEY
+	// OP_KEY_MATCHES accepts object members whose name the regular
+	// expression a matches.
+	OP_KEY_MATCHES
+	OP_ANY
+	OP_ROOT
+	OP_FIRST_CHILD
+	OP_LAST_CHILD
+	OP_ONLY_CHILD
+	OP_EMPTY
+	// OP_SCOPE accepts the node a `:has` is being evaluated for, or the
+	// root of the document outside of any.
+	OP_SCOPE
+	// OP_NTH_CHILD and OP_NTH_LAST_CHILD accept the elements at positions
+	// a*n + b, counted from the start or the end of their array.
+	OP_NTH_CHILD
+	OP_NTH_LAST_CHILD
+	// OP_CONTAINS accepts strings containing a.
+	OP_CONTAINS
+	// OP_MATCHES accepts strings matched by the regular expression a.
+	OP_MATCHES
+	// OP_VAL accepts nodes whose value is encoded as a.
+	OP_VAL
+	// OP_HAS accepts nodes with a child matched by selector a of the
+	// program, with a following sibling matched by it if b is
+	// hasFollowingSiblings, or with a descendant matched by it if b is
+	// hasDescendants.
+	OP_HAS
+	// OP_FAIL rejects every node; a is the reason.
+	OP_FAIL
+	// OP_NOT accepts nodes that selector a of the program does not match.
+	OP_NOT
+	// OP_IS accepts nodes that selector a of the program matches.
+	OP_IS
+	// OP_PARENT accepts nodes with a descendant b levels below them that
+	// selector a of the program matches.
+	OP_PARENT
+
+	// OP_EXPR starts evaluating an expression on an empty stack.
+	OP_EXPR
+	// OP_PUSH pushes constant a, OP_PUSH_X the value of the node, and
+	// OP_PUSH_PATH the value of the node path a leads to from it, or null.
+	OP_PUSH
+	OP_PUSH_X
+	OP_PUSH_PATH
+	// Binary operators pop their operands and push their result.
+	OP_MUL
+	OP_DIV
+	OP_MOD
+	OP_ADD
+	OP_SUB
+	OP_LE
+	OP_GE
+	OP_LT
+	OP_GT
+	OP_SUFFIX
+	OP_PREFIX
+	OP_SUBSTRING
+	OP_EQ
+	OP_NE
+	OP_AND
+	OP_OR
+	// OP_REGEX replaces the operand on top of the stack with whether it is
+	// a string matched by the regular expression a.
+	OP_REGEX
+	// OP_CALL replaces the b operands on top of the stack with the result
+	// of the expression function named a.
+	OP_CALL
+	// OP_TRUTHY pops the value of the expression and accepts the node if it
+	// is truthy.
+	OP_TRUTHY
+
+	opcodeCount
+)
+
+// The operand b of an OP_HAS is the axis its argument is evaluated over:
+// hasFollowingSiblings when the argument is relative to the node's
+// following siblings rather than its children, and hasDescendants when
+// it is anchored at the node by `>` or ` ` and may reach any depth below.
+const (
+	hasFollowingSiblings = 1
+	hasDescendants       = 2
+)
+
+var opcodeNames = [opcodeCount]string{
+	"STEP", "VALIDATOR", "DESCENDANT", "CHILD", "SIBLING", "ADJACENT", "UNION", "END",
+	"TYPE", "KEY", "KEY_MATCHES", "ANY", "ROOT", "FIRST_CHILD", "LAST_CHILD", "ONLY_CHILD", "EMPTY", "SCOPE",
+	"NTH_CHILD", "NTH_LAST_CHILD", "CONTAINS", "MATCHES", "VAL", "HAS", "FAIL", "NOT", "IS", "PARENT",
+	"EXPR", "PUSH", "PUSH_X", "PUSH_PATH",
+	"MUL", "DIV", "MOD", "ADD", "SUB", "LE", "GE", "LT", "GT",
+	"SUFFIX", "PREFIX", "SUBSTRING", "EQ", "NE", "AND", "OR",
+	"REGEX", "CALL", "TRUTHY",
+}
+
+func (op opcode) String() string {
+	if op < opcodeCount {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("opcode(%d)", uint8(op))
+}
+
+// joinOperators maps the opcodes ending a step to the combinator they
+// stand for, END's being empty.
+var joinOperators = map[opcode]string{
+	OP_DESCENDANT: " ",
+	OP_CHILD:      ">",
+	OP_SIBLING:    "~",
+	OP_ADJACENT:   "+",
+	OP_UNION:      ",",
+	OP_END:        "",
+}
+
+var joinOpcodes = map[string]opcode{
+	" ": OP_DESCENDANT,
+	">": OP_CHILD,
+	"~": OP_SIBLING,
+	"+": OP_ADJACENT,
+	",": OP_UNION,
+	"":  OP_END,
+}
+
+var binaryOpcodes = map[string]opcode{
+	"*":  OP_MUL,
+	"/":  OP_DIV,
+	"%":  OP_MOD,
+	"+":  OP_ADD,
+	"-":  OP_SUB,
+	"<=": OP_LE,
+	">=": OP_GE,
+	"<":  OP_LT,
+	">":  OP_GT,
+	"$=": OP_SUFFIX,
+	"^=": OP_PREFIX,
+	"*=": OP_SUBSTRING,
+	"=":  OP_EQ,
+	"!=": OP_NE,
+	"&&": OP_AND,
+	"||": OP_OR,
+}
+
+// validatorKinds lists the kinds a VALIDATOR instruction can declare.
+var validatorKinds = []tokenType{S_TYPE, S_IDENTIFIER, S_PCLASS, S_NTH_FUNC, S_PCLASS_FUNC, S_OPER, S_PARENT, S_KEY_PATTERN}
+
+type instruction struct {
+	op opcode
+	a  int32
+	b  int32
+}
+
+// Program is a compiled selector.  It does not depend on any document, so
+// it can be compiled once with Compile, evaluated against many documents
+// with GetCompiledValues, and stored with MarshalBinary.
+type Program struct {
+	selector string
+	code     []instruction
+	consts   []interface{}
+
+	// Set by link: the constants as expression operands, and the steps of
+	// each selector of the program, the first being the one compiled and
+	// the others those its validators refer to: the arguments of `:has`,
+	// `:not` and `:is` or `:where`, and the compounds `:parent` selects
+	// the ancestors of.
+	values    []exprElement
+	selectors [][]*selectorStep
+	// regexps and paths hold the regular expressions and node paths among
+	// the constants, decoded by the compiler or else by link, and functions
+	// the expression functions named by them.
+	regexps   map[int32]*regexp.Regexp
+	paths     map[int32]exprPath
+	functions map[int32]exprFunction
+	// logger receives the trace events of evaluating the program in place
+	// of the parser's, if it was compiled with WithLogger.
+	logger *slog.Logger
+}
+
+// Selector returns the selector the program was compiled from.
+func (prog *Program) Selector() string {
+	return prog.selector
+}
+
+// steps returns fresh copies of the steps of the program's selector, ready
+// to be planned against a document.
+func (prog *Program) steps() []*selectorStep {
+	templates := prog.selectors[0]
+	steps := make([]*selectorStep, len(templates))
+	copies := make([]selectorStep, len(templates))
+	for i, template := range templates {
+		copies[i] = selectorStep{
+			compound:   template.compound,
+			validators: template.validators,
+			operator:   template.operator,
+		}
+		steps[i] = &copies[i]
+	}
+	return steps
+}
+
+// String disassembles the program, one instruction per line.
+func (prog *Program) String() string {
+	var lines []string
+	for pc, in := range prog.code {
+		indent := "    "
+		switch in.op {
+		case OP_STEP:
+			indent = ""
+		case OP_VALIDATOR:
+			indent = "  "
+		case OP_DESCENDANT, OP_CHILD, OP_SIBLING, OP_ADJACENT, OP_UNION, OP_END:
+			indent = ""
+		}
+		line := fmt.Sprintf("%3d %s%s", pc, indent, in.op)
+		switch in.op {
+		case OP_STEP, OP_KEY, OP_KEY_MATCHES, OP_CONTAINS, OP_MATCHES, OP_VAL, OP_FAIL, OP_PUSH, OP_PUSH_PATH, OP_REGEX:
+			line += fmt.Sprintf(" %#v", prog.consts[in.a])
+		case OP_CALL:
+			line += fmt.Sprintf(" %#v %d", prog.consts[in.a], in.b)
+		case OP_VALIDATOR:
+			line += fmt.Sprintf(" %#v %s", prog.consts[in.a], validatorKinds[in.b])
+		case OP_TYPE:
+			line += " " + jsonType(in.a).String()
+		case OP_NTH_CHILD, OP_NTH_LAST_CHILD:
+			line += fmt.Sprintf(" %d %d", in.a, in.b)
+		case OP_PARENT:
+			line += fmt.Sprintf(" %d %d", in.a, in.b)
+		case OP_HAS, OP_NOT, OP_IS:
+			line += fmt.Sprintf(" %d", in.a)
+			if in.op == OP_HAS && in.b == hasFollowingSiblings {
+				line += " siblings"
+			} else if in.op == OP_HAS && in.b == hasDescendants {
+				line += " descendants"
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// link checks that the program is well formed, so that running it cannot
+// fail, and decodes the steps of its selectors.
+func (prog *Program) link() error {
+	prog.values = make([]exprElement, len(prog.consts))
+	for i, constant := range prog.consts {
+		switch constant.(type) {
+		case nil:
+			prog.values[i] = exprElement{constant, J_NULL}
+		case bool:
+			prog.values[i] = exprElement{constant, J_BOOLEAN}
+		case int64, float64:
+			prog.values[i] = exprElement{constant, J_NUMBER}
+		case string:
+			prog.values[i] = exprElement{constant, J_STRING}
+		default:
+			return errors.New(fmt.Sprintf("Unsupported constant %#v", constant))
+		}
+	}
+	isString := func(a int32) bool {
+		if a < 0 || int(a) >= len(prog.consts) {
+			return false
+		}
+		_, ok := prog.consts[a].(string)
+		return ok
+	}
+	if prog.regexps == nil {
+		prog.regexps = make(map[int32]*regexp.Regexp)
+	}
+	if prog.paths == nil {
+		prog.paths = make(map[int32]exprPath)
+	}
+	isPath := func(a int32) bool {
+		if !isString(a) {
+			return false
+		}
+		if _, ok := prog.paths[a]; !ok {
+			tokens, err := lex(prog.consts[a].(string), expressionScanner)
+			if err != nil || len(tokens) != 1 || tokens[0].typ != S_PATH {
+				return false
+			}
+			prog.paths[a] = tokens[0].val.(exprPath)
+		}
+		return true
+	}
+	prog.functions = make(map[int32]exprFunction)
+	isRegexp := func(a int32) bool {
+		if !isString(a) {
+			return false
+		}
+		if prog.regexps[a] == nil {
+			re, err := regexp.Compile(prog.consts[a].(string))
+			if err != nil {
+				return false
+			}
+			prog.regexps[a] = re
+		}
+		return true
+	}
+
+	prog.selectors = nil
+	var steps []*selectorStep
+	var step *selectorStep
+	// Instructions referring to other selectors of the program.
+	var references []int
+	// The depth of the expression stack, or -1 outside an expression.
+	depth := -1
+	closeValidator := func(pc int) error {
+		if depth != -1 {
+			return errors.New(fmt.Sprintf("Unterminated expression at %d", pc))
+		}
+		if step != nil && len(step.validators) > 0 {
+			step.validators[len(step.validators)-1].end = pc
+		}
+		return nil
+	}
+
+	for pc, in := range prog.code {
+		switch in.op {
+		case OP_STEP:
+			if step != nil || !isString(in.a) {
+				return invalidInstruction(pc, in)
+			}
+			step = &selectorStep{compound: prog.consts[in.a].(string)}
+			continue
+		case OP_VALIDATOR:
+			if step == nil || !isString(in.a) || in.b < 0 || int(in.b) >= len(validatorKinds) {
+				return invalidInstruction(pc, in)
+			}
+			if err := closeValidator(pc); err != nil {
+				return err
+			}
+			step.validators = append(step.validators, validator{
+				name:    prog.consts[in.a].(string),
+				kind:    validatorKinds[in.b],
+				program: prog,
+				start:   pc + 1,
+				end:     pc + 1,
+			})
+			continue
+		case OP_DESCENDANT, OP_CHILD, OP_SIBLING, OP_ADJACENT, OP_UNION, OP_END:
+			if step == nil || len(step.validators) == 0 {
+				return invalidInstruction(pc, in)
+			}
+			if err := closeValidator(pc); err != nil {
+				return err
+			}
+			step.operator = joinOperators[in.op]
+			steps = append(steps, step)
+			step = nil
+			if in.op == OP_END {
+				prog.selectors = append(prog.selectors, steps)
+				steps = nil
+			}
+			continue
+		}
+
+		// Everything else belongs to a validator.
+		if step == nil || len(step.validators) == 0 {
+			return invalidInstruction(pc, in)
+		}
+		switch in.op {
+		case OP_TYPE:
+			if in.a < int32(J_STRING) || in.a > int32(J_NULL) {
+				return invalidInstruction(pc, in)
+			}
+		case OP_KEY, OP_CONTAINS, OP_VAL, OP_FAIL:
+			if !isString(in.a) {
+				return invalidInstruction(pc, in)
+			}
+		case OP_KEY_MATCHES, OP_MATCHES:
+			if !isRegexp(in.a) {
+				return invalidInstruction(pc, in)
+			}
+		case OP_HAS, OP_NOT, OP_IS, OP_PARENT:
+			// Arguments follow the selector they appear in, which keeps
+			// programs from recursing forever.
+			if int(in.a) <= len(prog.selectors) || in.op == OP_HAS && in.b != 0 && in.b != hasFollowingSiblings && in.b != hasDescendants || in.op == OP_PARENT && in.b < 1 {
+				return invalidInstruction(pc, in)
+			}
+			references = append(references, pc)
+		case OP_ANY, OP_ROOT, OP_FIRST_CHILD, OP_LAST_CHILD, OP_ONLY_CHILD, OP_EMPTY, OP_SCOPE, OP_NTH_CHILD, OP_NTH_LAST_CHILD:
+		case OP_EXPR:
+			if depth != -1 {
+				return invalidInstruction(pc, in)
+			}
+			depth = 0
+			continue
+		case OP_PUSH, OP_PUSH_X, OP_PUSH_PATH:
+			if depth == -1 || (in.op == OP_PUSH && (in.a < 0 || int(in.a) >= len(prog.consts))) || in.op == OP_PUSH_PATH && !isPath(in.a) {
+				return invalidInstruction(pc, in)
+			}
+			depth++
+			continue
+		case OP_REGEX:
+			if depth < 1 || !isRegexp(in.a) {
+				return invalidInstruction(pc, in)
+			}
+			continue
+		case OP_CALL:
+			if !isString(in.a) {
+				return invalidInstruction(pc, in)
+			}
+			function, ok := exprFunctions[prog.consts[in.a].(string)]
+			if !ok || !function.accepts(int(in.b)) || depth < int(in.b) || depth == -1 {
+				return invalidInstruction(pc, in)
+			}
+			prog.functions[in.a] = function
+			depth -= int(in.b) - 1
+			continue
+		case OP_TRUTHY:
+			if depth != 1 {
+				return invalidInstruction(pc, in)
+			}
+			depth = -1
+			continue
+		default:
+			if in.op < OP_MUL || in.op > OP_OR || depth < 2 {
+				return invalidInstruction(pc, in)
+			}
+			depth--
+			continue
+		}
+		if depth != -1 {
+			return invalidInstruction(pc, in)
+		}
+	}
+	if step != nil || steps != nil || len(prog.selectors) == 0 {
+		return errors.New("Program is not terminated")
+	}
+	for _, pc := range references {
+		if int(prog.code[pc].a) >= len(prog.selectors) {
+			return invalidInstruction(pc, prog.code[pc])
+		}
+	}
+	return nil
+}
+
+func invalidInstruction(pc int, in instruction) error {
+	return errors.New(fmt.Sprintf("Invalid instruction %d: %s %d %d", pc, in.op, in.a, in.b))
+}
+
+// programMagic starts the binary encoding of a program, followed by its
+// version.
+const programMagic = "JSVM\x01"
+
+// Tags of the constants of an encoded program.
+const (
+	constNull byte = iota
+	constFalse
+	constTrue
+	constInt
+	constFloat
+	constString
+)
+
+// MarshalBinary encodes the program, for UnmarshalBinary to restore it
+// without compiling its selector again.
+func (prog *Program) MarshalBinary() ([]byte, error) {
+	buf := []byte(programMagic)
+	buf = appendString(buf, prog.selector)
+	buf = binary.AppendUvarint(buf, uint64(len(prog.consts)))
+	for _, constant := range prog.consts {
+		switch value := constant.(type) {
+		case nil:
+			buf = append(buf, constNull)
+		case bool:
+			if value {
+				buf = append(buf, constTrue)
+			} else {
+				buf = append(buf, constFalse)
+			}
+		case int64:
+			buf = binary.AppendVarint(append(buf, constInt), value)
+		case float64:
+			buf = binary.AppendUvarint(append(buf, constFloat), math.Float64bits(value))
+		case string:
+			buf = appendString(append(buf, constString), value)
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported constant %#v", constant))
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(prog.code)))
+	for _, in := range prog.code {
+		buf = append(buf, byte(in.op))
+		buf = binary.AppendVarint(buf, int64(in.a))
+		buf = binary.AppendVarint(buf, int64(in.b))
+	}
+	return buf, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(s))), s...)
+}
+
+// UnmarshalBinary restores a program encoded by MarshalBinary, checking
+// that it is well formed.
+func (prog *Program) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(programMagic)) {
+		return errors.New("Not a compiled selector")
+	}
+	r := &programReader{data: data[len(programMagic):]}
+	decoded := &Program{selector: r.string()}
+
+	count := r.count()
+	for i := 0; i < count && r.err == nil; i++ {
+		var constant interface{}
+		switch tag := r.byte(); tag {
+		case constNull:
+		case constFalse:
+			constant = false
+		case constTrue:
+			constant = true
+		case constInt:
+			constant = r.varint()
+		case constFloat:
+			constant = math.Float64frombits(r.uvarint())
+		case constString:
+			constant = r.string()
+		default:
+			r.fail()
+		}
+		decoded.consts = append(decoded.consts, constant)
+	}
+
+	count = r.count()
+	for i := 0; i < count && r.err == nil; i++ {
+		in := instruction{op: opcode(r.byte())}
+		in.a, in.b = r.int32(), r.int32()
+		if in.op >= opcodeCount {
+			r.fail()
+		}
+		decoded.code = append(decoded.code, in)
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.fail()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if err := decoded.link(); err != nil {
+		return err
+	}
+	*prog = *decoded
+	return nil
+}
+
+// programReader decodes the parts of an encoded program, recording the
+// first error encountered.
+type programReader struct {
+	data []byte
+	err  error
+}
+
+func (r *programReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("Malformed compiled selector")
+	}
+	r.data = nil
+}
+
+func (r *programReader) byte() byte {
+	if len(r.data) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *programReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *programReader) varint() int64 {
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *programReader) int32() int32 {
+	value := r.varint()
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		r.fail()
+		return 0
+	}
+	return int32(value)
+}
+
+// count reads the length of a sequence, which cannot exceed the number of
+// bytes left.
+func (r *programReader) count() int {
+	count := r.uvarint()
+	if count > uint64(len(r.data)) {
+		r.fail()
+		return 0
+	}
+	return int(count)
+}
+
+func (r *programReader) string() string {
+	length := r.count()
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
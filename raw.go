@@ -0,0 +1,493 @@
+package jsonselect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/coddingtonbear/go-simplejson"
+)
+
+// rawStep is a compound selector made only of a type, a key and `*`,
+// together with the combinator joining it to the next one.
+type rawStep struct {
+	typ      jsonType
+	key      string
+	keyed    bool
+	operator string
+}
+
+// rawSelector is a selector simple enough to be evaluated while scanning
+// a raw JSON document, without decoding it into a tree first.
+type rawSelector []rawStep
+
+// RawFrame describes a value met while scanning a raw document, for the
+// function passed to ScanValues.  Its methods are all that code generated
+// by jsonselect-gen relies on besides ScanValues itself.
+type RawFrame struct {
+	typ     jsonType
+	key     []byte
+	escaped bool
+	idx     int
+	// seen records which descendant-combinator steps of a rawSelector the
+	// value or one of its ancestors matches.
+	seen uint64
+}
+
+type rawScanner struct {
+	data []byte
+	pos  int
+	// Values are selected either by selector or, if set, by match.
+	selector rawSelector
+	match    func(frames []RawFrame) bool
+	frames   []RawFrame
+	results  []interface{}
+}
+
+// GetValuesFromBytes evaluates selector against the JSON document in body.
+// Selectors made only of types, keys, `*` and the child and descendant
+// combinators are answered by scanning body directly, without decoding it
+// or mapping its nodes; any other selector is handed to a Parser.  Either
+// way, the values returned are those GetValues would return, except that a
+// scan also reports values under duplicated object keys, which decoding
+// would have discarded.
+func GetValuesFromBytes(body []byte, selector string) ([]interface{}, error) {
+	raw, ok, err := compileRawSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return raw.getValues(body)
+	}
+
+	parser, err := CreateParserFromString(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return parser.GetValues(selector)
+}
+
+// compileRawSelector returns selector as a rawSelector, or false if it uses
+// anything a raw scan cannot evaluate.
+func compileRawSelector(selector string) (rawSelector, bool, error) {
+	program, err := compileSelector(selector)
+	if err != nil {
+		return nil, false, err
+	}
+	steps := program.selectors[0]
+	// Steps are tracked in a bit mask per frame.
+	if len(steps) > 64 {
+		return nil, false, nil
+	}
+
+	raw := make(rawSelector, len(steps))
+	for i, step := range steps {
+		switch step.operator {
+		case "", ">", " ":
+			raw[i].operator = step.operator
+		default:
+			return nil, false, nil
+		}
+		for _, validator := range step.validators {
+			switch validator.kind {
+			case S_TYPE:
+				raw[i].typ = getJsonType(validator.name)
+			case S_IDENTIFIER:
+				raw[i].key = validator.name[1:]
+				raw[i].keyed = true
+			case S_OPER:
+			default:
+				return nil, false, nil
+			}
+		}
+	}
+	return raw, true, nil
+}
+
+// Type returns the name of the value's type, as used by type selectors.
+func (f *RawFrame) Type() string {
+	return f.typ.String()
+}
+
+// HasKey reports whether the value is the member of an object named key,
+// as the selector `.key` would.
+func (f *RawFrame) HasKey(key string) bool {
+	// Like keyProduction, never match an empty key.
+	if len(f.key) <= len(`""`) {
+		return false
+	}
+	if f.escaped {
+		var decoded string
+		return json.Unmarshal(f.key, &decoded) == nil && decoded == key
+	}
+	return string(f.key[1:len(f.key)-1]) == key
+}
+
+// Index returns the one-based position of the value within its array, or
+// zero if it is not an array element.
+func (f *RawFrame) Index() int {
+	return f.idx
+}
+
+// ScanValues scans the JSON document in body and returns, in the order
+// GetValues would, the values for which selected returns true.  selected
+// is called as each value is reached, before its contents are scanned,
+// with the frames of the value's ancestors and, last, of the value itself.
+// It underlies the functions jsonselect-gen generates for raw documents,
+// and is kept compatible with the code it has generated.
+func ScanValues(body []byte, selected func(frames []RawFrame) bool) ([]interface{}, error) {
+	return scanRaw(body, nil, selected)
+}
+
+// Scanners are reused so that their frame stacks need not be reallocated.
+var rawScannerPool = sync.Pool{
+	New: func() interface{} {
+		return &rawScanner{frames: make([]RawFrame, 0, 16)}
+	},
+}
+
+func (r rawSelector) getValues(body []byte) ([]interface{}, error) {
+	return scanRaw(body, r, nil)
+}
+
+func scanRaw(body []byte, selector rawSelector, match func([]RawFrame) bool) ([]interface{}, error) {
+	scanner := rawScannerPool.Get().(*rawScanner)
+	scanner.data, scanner.pos = body, 0
+	scanner.selector, scanner.match = selector, match
+	scanner.results = make([]interface{}, 0)
+	defer func() {
+		scanner.data, scanner.selector, scanner.match, scanner.results = nil, nil, nil, nil
+		scanner.frames = scanner.frames[:0]
+		rawScannerPool.Put(scanner)
+	}()
+
+	scanner.skipWhitespace()
+	if err := scanner.value(nil, false, 0); err != nil {
+		return nil, err
+	}
+	// Like the decoder used by CreateParserFromString, anything after the
+	// first value is ignored.
+	return scanner.results, nil
+}
+
+// matches reports whether the frame satisfies the compound selector of step.
+func (s *rawScanner) matches(step *rawStep, frame *RawFrame) bool {
+	if step.typ != 0 && step.typ != frame.typ {
+		return false
+	}
+	return !step.keyed || frame.HasKey(step.key)
+}
+
+// selected reports whether the innermost frame is among the nodes the
+// selector matches: it must match the last step, and satisfy every other
+// step through its own frame or one of its ancestors'.
+func (s *rawScanner) selected() bool {
+	if s.match != nil {
+		return s.match(s.frames)
+	}
+	depth := len(s.frames) - 1
+	frame := &s.frames[depth]
+	if depth > 0 {
+		frame.seen = s.frames[depth-1].seen
+	}
+	last := len(s.selector) - 1
+	for i := range s.selector[:last] {
+		if s.selector[i].operator == " " && s.matches(&s.selector[i], frame) {
+			frame.seen |= 1 << uint(i)
+		}
+	}
+
+	if !s.matches(&s.selector[last], frame) {
+		return false
+	}
+	for i := range s.selector[:last] {
+		step := &s.selector[i]
+		switch step.operator {
+		case " ":
+			if frame.seen&(1<<uint(i)) == 0 {
+				return false
+			}
+		case ">":
+			if depth == 0 || !s.matches(step, &s.frames[depth-1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *rawScanner) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("Invalid JSON at offset %d: ", s.pos) + fmt.Sprintf(format, args...))
+}
+
+func (s *rawScanner) skipWhitespace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// value scans the value starting at the current position, key being the
+// raw, quoted key it is found under, if any, and idx its position within
+// its array, if any.
+func (s *rawScanner) value(key []byte, escaped bool, idx int) error {
+	if s.pos >= len(s.data) {
+		return s.errorf("unexpected end of input")
+	}
+	frame := RawFrame{key: key, escaped: escaped, idx: idx}
+	switch c := s.data[s.pos]; {
+	case c == '{':
+		frame.typ = J_OBJECT
+	case c == '[':
+		frame.typ = J_ARRAY
+	case c == '"':
+		frame.typ = J_STRING
+	case c == 't' || c == 'f':
+		frame.typ = J_BOOLEAN
+	case c == 'n':
+		frame.typ = J_NULL
+	case c == '-' || (c >= '0' && c <= '9'):
+		frame.typ = J_NUMBER
+	default:
+		return s.errorf("unexpected character %q", c)
+	}
+	s.frames = append(s.frames, frame)
+	selected := s.selected()
+	start := s.pos
+
+	var err error
+	switch frame.typ {
+	case J_OBJECT:
+		err = s.object()
+	case J_ARRAY:
+		err = s.array()
+	case J_STRING:
+		_, err = s.string()
+	case J_BOOLEAN:
+		if s.data[s.pos] == 't' {
+			err = s.literal("true")
+		} else {
+			err = s.literal("false")
+		}
+	case J_NULL:
+		err = s.literal("null")
+	case J_NUMBER:
+		err = s.number()
+	}
+	s.frames = s.frames[:len(s.frames)-1]
+	if err != nil {
+		return err
+	}
+
+	// Values are appended once their children have been, matching the
+	// order of a Parser's document map.
+	if selected {
+		value, err := decodeRawValue(frame.typ, s.data[start:s.pos])
+		if err != nil {
+			return err
+		}
+		s.results = append(s.results, value)
+	}
+	return nil
+}
+
+func (s *rawScanner) object() error {
+	s.pos++
+	s.skipWhitespace()
+	if s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+			return s.errorf("expected object key")
+		}
+		start := s.pos
+		escaped, err := s.string()
+		if err != nil {
+			return err
+		}
+		key := s.data[start:s.pos]
+		s.skipWhitespace()
+		if s.pos >= len(s.data) || s.data[s.pos] != ':' {
+			return s.errorf("expected ':' after object key")
+		}
+		s.pos++
+		s.skipWhitespace()
+		if err := s.value(key, escaped, 0); err != nil {
+			return err
+		}
+		s.skipWhitespace()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+			s.skipWhitespace()
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or '}' in object")
+		}
+	}
+}
+
+func (s *rawScanner) array() error {
+	s.pos++
+	s.skipWhitespace()
+	if s.pos < len(s.data) && s.data[s.pos] == ']' {
+		s.pos++
+		return nil
+	}
+	for idx := 1; ; idx++ {
+		if err := s.value(nil, false, idx); err != nil {
+			return err
+		}
+		s.skipWhitespace()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+			s.skipWhitespace()
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// string scans a quoted string, reporting whether it holds anything, such
+// as escapes or non-ASCII bytes, that must be decoded before comparing it.
+func (s *rawScanner) string() (bool, error) {
+	var escaped bool
+	s.pos++
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return escaped, nil
+		case c == '\\':
+			escaped = true
+			if s.pos+1 >= len(s.data) {
+				return false, s.errorf("unterminated string")
+			}
+			switch s.data[s.pos+1] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				s.pos += 2
+			case 'u':
+				if s.pos+6 > len(s.data) {
+					return false, s.errorf("unterminated string")
+				}
+				for _, h := range s.data[s.pos+2 : s.pos+6] {
+					if !(h >= '0' && h <= '9' || h >= 'a' && h <= 'f' || h >= 'A' && h <= 'F') {
+						return false, s.errorf("invalid unicode escape")
+					}
+				}
+				s.pos += 6
+			default:
+				return false, s.errorf("invalid escape")
+			}
+		case c < 0x20:
+			return false, s.errorf("control character in string")
+		default:
+			if c >= 0x80 {
+				escaped = true
+			}
+			s.pos++
+		}
+	}
+	return false, s.errorf("unterminated string")
+}
+
+func (s *rawScanner) literal(literal string) error {
+	if len(s.data)-s.pos < len(literal) || string(s.data[s.pos:s.pos+len(literal)]) != literal {
+		return s.errorf("expected %s", literal)
+	}
+	s.pos += len(literal)
+	return nil
+}
+
+func (s *rawScanner) digits() int {
+	start := s.pos
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		s.pos++
+	}
+	return s.pos - start
+}
+
+func (s *rawScanner) number() error {
+	if s.data[s.pos] == '-' {
+		s.pos++
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == '0' {
+		s.pos++
+	} else if s.digits() == 0 {
+		return s.errorf("invalid number")
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == '.' {
+		s.pos++
+		if s.digits() == 0 {
+			return s.errorf("invalid number")
+		}
+	}
+	if s.pos < len(s.data) && (s.data[s.pos] == 'e' || s.data[s.pos] == 'E') {
+		s.pos++
+		if s.pos < len(s.data) && (s.data[s.pos] == '+' || s.data[s.pos] == '-') {
+			s.pos++
+		}
+		if s.digits() == 0 {
+			return s.errorf("invalid number")
+		}
+	}
+	return nil
+}
+
+// decodeRawValue converts a matched value to the form GetValues returns.
+func decodeRawValue(typ jsonType, raw []byte) (interface{}, error) {
+	switch typ {
+	case J_NUMBER:
+		// Out of range numbers become infinities, as when mapping.
+		value, _ := strconv.ParseFloat(string(raw), 64)
+		return value, nil
+	case J_BOOLEAN:
+		return raw[0] == 't', nil
+	case J_NULL:
+		return nil, nil
+	case J_STRING:
+		if !rawStringNeedsDecoding(raw) {
+			return string(raw[1 : len(raw)-1]), nil
+		}
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	}
+	// Decode containers the way CreateParserFromString does, so that
+	// nested numbers are represented identically.
+	document, err := simplejson.NewJson(raw)
+	if err != nil {
+		return nil, err
+	}
+	return document.Interface(), nil
+}
+
+func rawStringNeedsDecoding(raw []byte) bool {
+	for _, c := range raw {
+		if c == '\\' || c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
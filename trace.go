@@ -0,0 +1,161 @@
+package jsonselect
+
+// Trace describes how a selector was evaluated against a document; it is
+// returned by Parser.Explain and can be serialized with encoding/json.
+type Trace struct {
+	Selector string     `json:"selector"`
+	Root     *TraceStep `json:"root"`
+	// Matches holds the JSON Pointer of every node the selector matched.
+	Matches []string `json:"matches"`
+}
+
+// TraceStep describes a single compound selector (e.g. `object:has(.a)`)
+// and, if one follows it, the combinator joining it to the rest of the
+// selector.
+type TraceStep struct {
+	Step     int    `json:"step"`
+	Selector string `json:"selector"`
+	// Strategy is the plan's strategy for the step; Nodes counts the
+	// candidates it scanned or the relatives it probed.
+	Strategy   string            `json:"strategy"`
+	Nodes      int               `json:"nodes"`
+	Validators []*TraceValidator `json:"validators"`
+	// Matched is the number of nodes accepted by every validator.
+	Matched    int              `json:"matched"`
+	Combinator *TraceCombinator `json:"combinator,omitempty"`
+	Next       *TraceStep       `json:"next,omitempty"`
+	// Results is the number of nodes this step hands back to its caller
+	// once the combinator, if any, has been applied.
+	Results int `json:"results"`
+
+	validators []validator
+	matched    []*jsonNode
+	results    []*jsonNode
+}
+
+// TraceValidator counts how many of the nodes that reached a validator it
+// kept or rejected.
+type TraceValidator struct {
+	Name           string                `json:"name"`
+	Kept           int                   `json:"kept"`
+	Rejected       int                   `json:"rejected"`
+	SubEvaluations []*TraceSubEvaluation `json:"subEvaluations,omitempty"`
+}
+
+// TraceSubEvaluation records the evaluation of a `:has` argument for one
+// candidate node: how many of its children were examined and the first of
+// them, if any, the argument matched.
+type TraceSubEvaluation struct {
+	Node     string `json:"node"`
+	Children int    `json:"children"`
+	Match    string `json:"match,omitempty"`
+}
+
+// TraceCombinator records the sizes of the node sets joined by a
+// combinator and the size of the set it produced.
+type TraceCombinator struct {
+	Operator string `json:"operator"`
+	Left     int    `json:"left"`
+	Right    int    `json:"right"`
+	Output   int    `json:"output"`
+}
+
+type traceRecorder struct {
+	// slot is where the next step created by executeStep is stored.
+	slot      **TraceStep
+	validator *TraceValidator
+}
+
+// Explain evaluates selector like GetValues, but returns a description of
+// how every part of the selector narrowed down the document.
+func (p *Parser) Explain(selector string) (*Trace, error) {
+	trace, _, err := p.explain(selector)
+	return trace, err
+}
+
+func (p *Parser) explain(selector string) (*Trace, []*jsonNode, error) {
+	program, err := compileSelector(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	trace := &Trace{Selector: selector, Matches: []string{}}
+	nodes, err := p.evaluateProgram(program, &traceRecorder{slot: &trace.Root})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range nodes {
+		trace.Matches = append(trace.Matches, node.pointer())
+	}
+	return trace, nodes, nil
+}
+
+func (m *machine) traceStep(recursionDepth int, compound string, validators []validator, nodes int) *TraceStep {
+	if m.trace == nil {
+		return nil
+	}
+	step := &TraceStep{
+		Step:       recursionDepth,
+		Selector:   compound,
+		Nodes:      nodes,
+		Validators: make([]*TraceValidator, 0, len(validators)),
+		validators: validators,
+	}
+	for _, validator := range validators {
+		step.Validators = append(step.Validators, &TraceValidator{Name: validator.name})
+	}
+	*m.trace.slot = step
+	return step
+}
+
+func (m *machine) traceValidatorStart(validator *TraceValidator) {
+	m.trace.validator = validator
+}
+
+func (m *machine) traceDescend(step *TraceStep) {
+	if step != nil {
+		m.trace.slot = &step.Next
+	}
+}
+
+// suspendTrace detaches the validator currently being applied, so that
+// validators it evaluates in turn, such as those of a `:has` argument, are
+// not attributed to it; pass the result to resumeTrace afterwards.
+func (m *machine) suspendTrace() *TraceValidator {
+	if m.trace == nil {
+		return nil
+	}
+	validator := m.trace.validator
+	m.trace.validator = nil
+	return validator
+}
+
+func (m *machine) resumeTrace(validator *TraceValidator) {
+	if m.trace != nil {
+		m.trace.validator = validator
+	}
+}
+
+func (m *machine) traceHasEvaluation(node *jsonNode, children int, match *jsonNode) {
+	if m.trace == nil || m.trace.validator == nil {
+		return
+	}
+	sub := &TraceSubEvaluation{Node: node.pointer(), Children: children}
+	if match != nil {
+		sub.Match = match.pointer()
+	}
+	m.trace.validator.SubEvaluations = append(m.trace.validator.SubEvaluations, sub)
+}
+
+func (v *TraceValidator) record(kept bool) {
+	if kept {
+		v.Kept++
+	} else {
+		v.Rejected++
+	}
+}
+
+func traceCombinator(step *TraceStep, operator string, left int, right int, output int) {
+	if step != nil {
+		step.Combinator = &TraceCombinator{operator, left, right, output}
+	}
+}
@@ -3,49 +3,54 @@ package jsonselect
 import (
 	"encoding/json"
 	"log"
+	"sort"
 	"strconv"
-
-	"github.com/coddingtonbear/go-simplejson"
 )
 
-func nodeIsMemberOfHaystack(needle *jsonNode, haystack map[*simplejson.Json]*jsonNode) bool {
-	_, ok := haystack[needle.json]
+func nodeIsMemberOfHaystack(needle *jsonNode, haystack map[*jsonNode]*jsonNode) bool {
+	_, ok := haystack[needle]
 	return ok
 }
 
 func nodeIsMemberOfList(needle *jsonNode, haystack []*jsonNode) bool {
 	for _, element := range haystack {
-		if element.json == needle.json {
+		if element == needle {
 			return true
 		}
 	}
 	return false
 }
 
-func appendAncestorsToHaystack(node *jsonNode, haystack map[*simplejson.Json]*jsonNode) {
+func appendAncestorsToHaystack(node *jsonNode, haystack map[*jsonNode]*jsonNode) {
 	if node.parent != nil {
-		haystack[node.parent.json] = node.parent
+		haystack[node.parent] = node.parent
 		appendAncestorsToHaystack(node.parent, haystack)
 	}
 }
 
-func nodeIsChildOfHaystackMember(needle *jsonNode, haystack map[*simplejson.Json]*jsonNode) bool {
-	if nodeIsMemberOfHaystack(needle, haystack) {
-		return true
-	}
-	if needle.parent == nil {
-		return false
-	}
-	return nodeIsChildOfHaystackMember(needle.parent, haystack)
+// getPreorderSortedNodes returns a copy of nodes ordered by pre-order
+// number, i.e. in document order.
+func getPreorderSortedNodes(nodes []*jsonNode) []*jsonNode {
+	sorted := make([]*jsonNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].pre() < sorted[j].pre()
+	})
+	return sorted
 }
 
 func parents(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
 	var results []*jsonNode
 
-	lhsHaystack := getHaystackFromNodeList(lhs)
+	sortedLhs := getPreorderSortedNodes(lhs)
 
 	for _, element := range rhs {
-		if element.parent != nil && nodeIsMemberOfHaystack(element.parent, lhsHaystack) {
+		if element.parent == nil {
+			continue
+		}
+		pre := element.parent.pre()
+		i := sort.Search(len(sortedLhs), func(i int) bool { return sortedLhs[i].pre() >= pre })
+		if i < len(sortedLhs) && sortedLhs[i].pre() == pre {
 			results = append(results, element)
 		}
 	}
@@ -55,10 +60,21 @@ func parents(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
 
 func ancestors(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
 	var results []*jsonNode
-	haystack := getHaystackFromNodeList(lhs)
+
+	// Two subtrees are either nested or disjoint, so the subtrees rooted
+	// at lhs are covered by those of its outermost members.  Kept in
+	// pre-order, the only one that can contain a given node is the last
+	// one starting at or before it.
+	var outermost []*jsonNode
+	for _, node := range getPreorderSortedNodes(lhs) {
+		if len(outermost) == 0 || node.post > outermost[len(outermost)-1].post {
+			outermost = append(outermost, node)
+		}
+	}
 
 	for _, element := range rhs {
-		if nodeIsChildOfHaystackMember(element, haystack) {
+		i := sort.Search(len(outermost), func(i int) bool { return outermost[i].pre() > element.pre() }) - 1
+		if i >= 0 && element.post <= outermost[i].post {
 			results = append(results, element)
 		}
 	}
@@ -66,18 +82,41 @@ func ancestors(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
 	return results
 }
 
+// siblings keeps the nodes of rhs preceded by a sibling in lhs.  Siblings
+// are numbered in document order, so it is enough to know the first member
+// of lhs under each parent.
 func siblings(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
 	var results []*jsonNode
-	parents := make(map[*simplejson.Json]*jsonNode, len(lhs))
+	first := make(map[*jsonNode]int32, len(lhs))
 
 	for _, element := range lhs {
-		if element.parent != nil {
-			parents[element.parent.json] = element.parent
+		if element.parent == nil {
+			continue
+		}
+		if pre, ok := first[element.parent]; !ok || element.pre() < pre {
+			first[element.parent] = element.pre()
+		}
+	}
+
+	for _, element := range rhs {
+		if element.parent == nil {
+			continue
+		}
+		if pre, ok := first[element.parent]; ok && pre < element.pre() {
+			results = append(results, element)
 		}
 	}
 
+	return results
+}
+
+// adjacent keeps the nodes of rhs immediately preceded by a sibling in lhs.
+func (p *Parser) adjacent(lhs []*jsonNode, rhs []*jsonNode) []*jsonNode {
+	var results []*jsonNode
+	haystack := getHaystackFromNodeList(lhs)
+
 	for _, element := range rhs {
-		if element.parent != nil && nodeIsMemberOfHaystack(element.parent, parents) {
+		if previous := p.previousSibling(element); previous != nil && nodeIsMemberOfHaystack(previous, haystack) {
 			results = append(results, element)
 		}
 	}
@@ -140,7 +179,7 @@ func exprElementIsTruthy(e exprElement) bool {
 	case J_STRING:
 		return len(e.value.(string)) > 0
 	case J_NUMBER:
-		return e.value.(float64) > 0
+		return getFloat64(e.value) > 0
 	case J_OBJECT:
 		return true
 	case J_ARRAY:
@@ -158,10 +197,23 @@ func exprElementsMatch(lhs exprElement, rhs exprElement) bool {
 	return lhs.typ == rhs.typ
 }
 
-func getHaystackFromNodeList(nodes []*jsonNode) map[*simplejson.Json]*jsonNode {
-	hashmap := make(map[*simplejson.Json]*jsonNode, len(nodes))
+// exprElementIsNumeric reports whether getFloat64 can convert the value of
+// e: a number, or a string spelling one out.
+func exprElementIsNumeric(e exprElement) bool {
+	switch value := e.value.(type) {
+	case float64, int64:
+		return true
+	case string:
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	}
+	return false
+}
+
+func getHaystackFromNodeList(nodes []*jsonNode) map[*jsonNode]*jsonNode {
+	hashmap := make(map[*jsonNode]*jsonNode, len(nodes))
 	for _, node := range nodes {
-		hashmap[node.json] = node
+		hashmap[node] = node
 	}
 	return hashmap
 }
@@ -0,0 +1,316 @@
+package jsonselect
+
+import (
+	"strings"
+)
+
+// machine holds what running a program's validators needs besides the
+// node being validated; every query has one of its own.
+type machine struct {
+	// stack holds the operands of the expression being evaluated.
+	stack []exprElement
+	// has memoizes whether a node has a match for a `:has` argument, by
+	// selector then post-order number of the node, since a node's subtree
+	// is the same wherever it is reached from.
+	has map[int32]map[int32]bool
+	// parents memoizes the nodes a `:parent` selects, by its argument and
+	// the scope it was evaluated in.
+	parents map[parentKey]map[*jsonNode]bool
+	// scope is the node the innermost `:has` being evaluated is for, which
+	// `:scope` matches; outside of any, it is nil and `:scope` matches the
+	// root.
+	scope *jsonNode
+	// log is the query's own copy of the logger, keeping track of the step
+	// and recursion depth the query has reached; logging caches whether it
+	// is enabled.
+	log     logHandler
+	logging bool
+	// profile holds the measurements open for the query, if it is
+	// profiled.
+	profile *profileState
+	// trace records the evaluation for Explain, if it is being traced.
+	trace *traceRecorder
+}
+
+// parentKey identifies a `:parent` argument evaluated within a scope.
+type parentKey struct {
+	selector int32
+	scope    *jsonNode
+}
+
+// validate runs the predicates of validator against node, reporting whether
+// all of them held.
+func (p *Parser) validate(m *machine, v validator, node *jsonNode) bool {
+	program := v.program
+	matched := true
+	stack := m.stack[:0]
+
+	for _, in := range program.code[v.start:v.end] {
+		switch in.op {
+		case OP_TYPE:
+			matched = node.typ == jsonType(in.a)
+		case OP_KEY:
+			matched = node.parentKey() != "" && node.parentKey() == program.consts[in.a].(string)
+		case OP_KEY_MATCHES:
+			matched = node.parent != nil && node.parent.typ == J_OBJECT && program.regexps[in.a].MatchString(node.parentKey())
+		case OP_ANY:
+		case OP_ROOT:
+			matched = node.parent == nil
+		case OP_FIRST_CHILD:
+			matched = node.idx == 1
+		case OP_LAST_CHILD:
+			matched = node.siblings() > 0 && node.idx == node.siblings()
+		case OP_ONLY_CHILD:
+			matched = node.siblings() == 1
+		case OP_EMPTY:
+			matched = node.typ == J_ARRAY && !nodeHasChildren(node)
+		case OP_SCOPE:
+			if m.scope == nil {
+				matched = node.parent == nil
+			} else {
+				// The scope stands in as the root of its own subtree, as a
+				// copy sharing its numbers.
+				matched = node.pre() == m.scope.pre()
+			}
+		case OP_NTH_CHILD, OP_NTH_LAST_CHILD:
+			matched = nthChildMatches(node, int(in.a), int(in.b), in.op == OP_NTH_LAST_CHILD)
+		case OP_CONTAINS:
+			matched = node.typ == J_STRING && strings.Contains(node.payload.(string), program.consts[in.a].(string))
+		case OP_MATCHES:
+			matched = node.typ == J_STRING && program.regexps[in.a].MatchString(node.payload.(string))
+		case OP_VAL:
+			matched = getJsonString(node.value()) == program.consts[in.a].(string)
+		case OP_HAS:
+			matched = p.hasMatches(m, v, in.a, in.b, node)
+		case OP_NOT, OP_IS:
+			suspended := m.suspendTrace()
+			matched = p.selectorMatches(m, program.selectors[in.a], 0, node) == (in.op == OP_IS)
+			m.resumeTrace(suspended)
+		case OP_PARENT:
+			suspended := m.suspendTrace()
+			matched = p.parentMatches(m, in.a, program.selectors[in.a], in.b, node)
+			m.resumeTrace(suspended)
+		case OP_FAIL:
+			matched = false
+			if m.logging {
+				m.log.Trace("validate", "validator", v.name, "node", node, "matched", false, "reason", program.consts[in.a])
+				return false
+			}
+
+		case OP_EXPR:
+			m.profileCount("expr", v.name, 1)
+			stack = stack[:0]
+		case OP_PUSH:
+			stack = append(stack, program.values[in.a])
+		case OP_PUSH_X:
+			stack = append(stack, exprElement{node.value(), node.typ})
+		case OP_PUSH_PATH:
+			if target := p.followPath(node, program.paths[in.a]); target != nil {
+				stack = append(stack, exprElement{target.value(), target.typ})
+			} else {
+				stack = append(stack, exprElement{nil, J_NULL})
+			}
+		case OP_REGEX:
+			operand := stack[len(stack)-1]
+			s, ok := operand.value.(string)
+			stack[len(stack)-1] = exprElement{ok && program.regexps[in.a].MatchString(s), J_BOOLEAN}
+		case OP_CALL:
+			arguments := len(stack) - int(in.b)
+			result := program.functions[in.a].apply(node, stack[arguments:])
+			stack = append(stack[:arguments], result)
+		case OP_TRUTHY:
+			matched = exprElementIsTruthy(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		default:
+			lhs, rhs := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			switch {
+			case !exprElementsMatch(lhs, rhs):
+				if m.logging {
+					m.log.Trace("cannot compare expression elements; types differ", "lhs", lhs.value, "lhsType", lhs.typ, "rhs", rhs.value, "rhsType", rhs.typ)
+				}
+				stack = append(stack, exprElement{false, J_BOOLEAN})
+			case in.op <= OP_GT && !(exprElementIsNumeric(lhs) && exprElementIsNumeric(rhs)):
+				// Arithmetic and ordering need numbers, which functions
+				// returning null for want of one cannot provide.
+				if m.logging {
+					m.log.Trace("cannot compute with expression elements; not numbers", "lhs", lhs.value, "lhsType", lhs.typ, "rhs", rhs.value, "rhsType", rhs.typ)
+				}
+				stack = append(stack, exprElement{false, J_BOOLEAN})
+			default:
+				stack = append(stack, binaryOperations[in.op](lhs, rhs))
+			}
+		}
+		if !matched {
+			break
+		}
+	}
+	// Keep the stack's storage for the next expression.
+	m.stack = stack[:0]
+
+	if m.logging {
+		m.log.Trace("validate", "validator", v.name, "node", node, "matched", matched)
+	}
+	return matched
+}
+
+// nthChildMatches reports whether node is an array element at a position
+// a*n + b for some n >= 0, counting from the end of the array if reverse.
+func nthChildMatches(node *jsonNode, a int, b int, reverse bool) bool {
+	if node.siblings() == 0 {
+		return false
+	}
+
+	position := int(node.idx)
+	if reverse {
+		position = int(node.siblings()) - position + 1
+	}
+
+	if a == 0 {
+		return position == b
+	}
+	return (position-b)%a == 0 && (position-b)/a >= 0
+}
+
+// nodePassesValidators reports whether node is accepted by every validator.
+func (p *Parser) nodePassesValidators(m *machine, validators []validator, node *jsonNode) bool {
+	for _, validator := range validators {
+		if !p.validate(m, validator, node) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorMatches reports whether node is among the nodes selected by
+// steps[i:] in the whole document.  Rather than evaluating the selector,
+// it checks the rightmost compound against node and each combinator
+// against node's relatives, just as probing does.
+func (p *Parser) selectorMatches(m *machine, steps []*selectorStep, i int, node *jsonNode) bool {
+	step := steps[i]
+	switch step.operator {
+	case "":
+		return p.nodePassesValidators(m, step.validators, node)
+	case ",":
+		return p.nodePassesValidators(m, step.validators, node) || p.selectorMatches(m, steps, i+1, node)
+	}
+
+	if !p.selectorMatches(m, steps, i+1, node) {
+		return false
+	}
+	switch step.operator {
+	case " ":
+		for ancestor := node; ancestor != nil; ancestor = ancestor.parent {
+			if p.nodePassesValidators(m, step.validators, ancestor) {
+				return true
+			}
+		}
+	case ">":
+		return node.parent != nil && p.nodePassesValidators(m, step.validators, node.parent)
+	case "~":
+		for sibling := p.previousSibling(node); sibling != nil; sibling = p.previousSibling(sibling) {
+			if p.nodePassesValidators(m, step.validators, sibling) {
+				return true
+			}
+		}
+	case "+":
+		previous := p.previousSibling(node)
+		return previous != nil && p.nodePassesValidators(m, step.validators, previous)
+	}
+	return false
+}
+
+// parentMatches reports whether node lies levels above one of the nodes
+// selected by steps.  Those nodes are found once per query and scope, and
+// each is followed up its parents to the node it makes a match.
+func (p *Parser) parentMatches(m *machine, selector int32, steps []*selectorStep, levels int32, node *jsonNode) bool {
+	key := parentKey{selector: selector, scope: m.scope}
+	parents, found := m.parents[key]
+	if !found {
+		parents = map[*jsonNode]bool{}
+		for i := range p.nodes {
+			candidate := &p.nodes[i]
+			if int32(candidate.depth) < levels || !p.selectorMatches(m, steps, 0, candidate) {
+				continue
+			}
+			parent := candidate
+			for i := int32(0); i < levels; i++ {
+				parent = parent.parent
+			}
+			parents[parent] = true
+		}
+		if m.parents == nil {
+			m.parents = map[parentKey]map[*jsonNode]bool{}
+		}
+		m.parents[key] = parents
+	}
+	return parents[node]
+}
+
+// followPath returns the node path leads to from node, or nil if there is
+// none.  Members are looked up among the children of their object, from
+// the last one back.
+func (p *Parser) followPath(node *jsonNode, path exprPath) *jsonNode {
+	for i := 0; i < path.levels && node != nil; i++ {
+		node = node.parent
+	}
+	for _, key := range path.keys {
+		if node == nil || node.typ != J_OBJECT || node.descendants == 0 {
+			return nil
+		}
+		member := &p.nodes[node.post-1]
+		for member != nil && member.parentKey() != key {
+			member = p.previousSibling(member)
+		}
+		node = member
+	}
+	return node
+}
+
+// matchNodes returns the nodes accepted by every validator among
+// candidates.
+func (p *Parser) matchNodes(m *machine, validators []validator, candidates []*jsonNode, step *TraceStep) []*jsonNode {
+	var matches []*jsonNode
+	for _, node := range candidates {
+		if p.nodeMatches(m, validators, node, step) {
+			if m.logging {
+				m.log.Trace("node matched", "node", node)
+			}
+			matches = append(matches, node)
+		}
+	}
+	return matches
+}
+
+// matchDocument is matchNodes with every node of the document as a
+// candidate.
+func (p *Parser) matchDocument(m *machine, validators []validator, step *TraceStep) []*jsonNode {
+	var matches []*jsonNode
+	for i := range p.nodes {
+		node := &p.nodes[i]
+		if p.nodeMatches(m, validators, node, step) {
+			if m.logging {
+				m.log.Trace("node matched", "node", node)
+			}
+			matches = append(matches, node)
+		}
+	}
+	return matches
+}
+
+// nodeMatches is nodePassesValidators, counting each validator's outcome
+// in step when a trace is being recorded.
+func (p *Parser) nodeMatches(m *machine, validators []validator, node *jsonNode, step *TraceStep) bool {
+	if step == nil {
+		return p.nodePassesValidators(m, validators, node)
+	}
+	for i, validator := range validators {
+		m.traceValidatorStart(step.Validators[i])
+		ok := p.validate(m, validator, node)
+		step.Validators[i].record(ok)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
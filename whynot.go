@@ -0,0 +1,188 @@
+package jsonselect
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WhyNotReport explains whether a selector matched the node at a JSON
+// Pointer and, if it did not, which part of the selector excluded it.
+type WhyNotReport struct {
+	Selector string `json:"selector"`
+	Pointer  string `json:"pointer"`
+	Matched  bool   `json:"matched"`
+	// Step is the compound selector that excluded the node, and Component
+	// the validator or combinator within it responsible for doing so.
+	Step      string `json:"step,omitempty"`
+	Component string `json:"component,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (r *WhyNotReport) String() string {
+	if r.Matched {
+		return fmt.Sprintf("%q matched by `%s`", r.Pointer, r.Selector)
+	}
+	return fmt.Sprintf("%q not matched by `%s`: %s", r.Pointer, r.Selector, r.Reason)
+}
+
+// WhyNot evaluates selector and reports the first validator or combinator
+// that excluded the node found at pointer, an RFC 6901 JSON Pointer such
+// as "/beers/0".
+func (p *Parser) WhyNot(selector string, pointer string) (*WhyNotReport, error) {
+	node := p.nodeAtPointer(pointer)
+	if node == nil {
+		return nil, errors.New(fmt.Sprintf("No node found at %q", pointer))
+	}
+
+	trace, _, err := p.explain(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &WhyNotReport{Selector: selector, Pointer: pointer, Matched: true}
+	exclusion := p.diagnoseStep(trace.Root, node)
+	if exclusion != nil {
+		report.Matched = false
+		report.Step = exclusion.Step
+		report.Component = exclusion.Component
+		report.Reason = exclusion.Reason
+	}
+	return report, nil
+}
+
+// diagnoseStep returns nil if node is among the results of step, and
+// otherwise describes the first thing, reading from the node's own
+// compound selector leftwards, that excluded it.
+func (p *Parser) diagnoseStep(step *TraceStep, node *jsonNode) *WhyNotReport {
+	if step == nil || nodeIsMemberOfList(node, step.results) {
+		return nil
+	}
+	if step.Combinator == nil || step.Next == nil {
+		return p.diagnoseCompound(step, node)
+	}
+
+	if step.Combinator.Operator == "," {
+		left := p.diagnoseCompound(step, node)
+		right := p.diagnoseStep(step.Next, node)
+		if left == nil || right == nil {
+			return nil
+		}
+		return &WhyNotReport{
+			Step:      step.Selector,
+			Component: ",",
+			Reason:    fmt.Sprintf("no alternative matched: %s; %s", left.Reason, right.Reason),
+		}
+	}
+
+	if exclusion := p.diagnoseStep(step.Next, node); exclusion != nil {
+		return exclusion
+	}
+
+	exclusion := &WhyNotReport{Step: step.Selector}
+	switch step.Combinator.Operator {
+	case " ":
+		exclusion.Component = "descendant combinator"
+		exclusion.Reason = fmt.Sprintf("no ancestor matched `%s`", step.Selector)
+	case ">":
+		exclusion.Component = "child combinator"
+		if node.parent == nil {
+			exclusion.Reason = fmt.Sprintf("node has no parent to match `%s`", step.Selector)
+		} else if parentExclusion := p.diagnoseCompound(step, node.parent); parentExclusion != nil {
+			exclusion.Reason = fmt.Sprintf("parent %q did not match `%s`: %s", node.parent.pointer(), step.Selector, parentExclusion.Reason)
+		} else {
+			exclusion.Reason = fmt.Sprintf("parent %q did not match `%s`", node.parent.pointer(), step.Selector)
+		}
+	case "~":
+		exclusion.Component = "sibling combinator"
+		exclusion.Reason = fmt.Sprintf("no preceding sibling matched `%s`", step.Selector)
+	case "+":
+		exclusion.Component = "adjacent sibling combinator"
+		previous := p.previousSibling(node)
+		if previous == nil {
+			exclusion.Reason = fmt.Sprintf("node has no preceding sibling to match `%s`", step.Selector)
+		} else if previousExclusion := p.diagnoseCompound(step, previous); previousExclusion != nil {
+			exclusion.Reason = fmt.Sprintf("preceding sibling %q did not match `%s`: %s", previous.pointer(), step.Selector, previousExclusion.Reason)
+		} else {
+			exclusion.Reason = fmt.Sprintf("preceding sibling %q did not match `%s`", previous.pointer(), step.Selector)
+		}
+	default:
+		exclusion.Component = step.Combinator.Operator
+		exclusion.Reason = fmt.Sprintf("combinator `%s` excluded the node", step.Combinator.Operator)
+	}
+	return exclusion
+}
+
+// diagnoseCompound re-applies the validators of a single compound selector
+// to node and describes the first one rejecting it.
+func (p *Parser) diagnoseCompound(step *TraceStep, node *jsonNode) *WhyNotReport {
+	m := &machine{}
+	for _, validator := range step.validators {
+		if !p.validate(m, validator, node) {
+			return &WhyNotReport{
+				Step:      step.Selector,
+				Component: validator.name,
+				Reason:    describeRejection(validator, node),
+			}
+		}
+	}
+	return nil
+}
+
+func describeRejection(v validator, node *jsonNode) string {
+	switch v.kind {
+	case S_TYPE:
+		return fmt.Sprintf("type `%s` != `%s`", node.typ, v.name)
+	case S_IDENTIFIER:
+		if node.parentKey() == "" {
+			return fmt.Sprintf("node has no key to compare with `%s`", v.name[1:])
+		}
+		return fmt.Sprintf("key `%s` != `%s`", node.parentKey(), v.name[1:])
+	case S_KEY_PATTERN:
+		if node.parent == nil || node.parent.typ != J_OBJECT {
+			return fmt.Sprintf("node has no key to compare with `%s`", v.name[1:])
+		}
+		return fmt.Sprintf("key `%s` does not match `%s`", node.parentKey(), v.name[1:])
+	case S_PCLASS, S_NTH_FUNC:
+		if v.name == ":root" {
+			return "node is not the document root"
+		}
+		if v.name == ":scope" {
+			return "node is not the scope of the selector"
+		}
+		if node.siblings() == 0 {
+			return fmt.Sprintf("`%s` only holds for array elements", v.name)
+		}
+		return fmt.Sprintf("`%s` does not hold for child %d of %d", v.name, node.idx, node.siblings())
+	case S_PARENT:
+		return fmt.Sprintf("node is not among those `%s` selects", v.name)
+	case S_PCLASS_FUNC:
+		value := getJsonString(node.value())
+		switch {
+		case strings.HasPrefix(v.name, ":expr"):
+			return fmt.Sprintf("`%s` evaluated to false with x=%s", v.name, value)
+		case strings.HasPrefix(v.name, ":has"):
+			inner := strings.TrimSpace(strings.TrimPrefix(v.name, ":has"))
+			inner = strings.TrimSpace(inner[1 : len(inner)-1])
+			if strings.HasPrefix(inner, "~") || strings.HasPrefix(inner, "+") {
+				return fmt.Sprintf("no following sibling matched `%s`", inner)
+			}
+			return fmt.Sprintf("no descendant matched `%s`", inner)
+		case strings.HasPrefix(v.name, ":not"):
+			inner := strings.TrimSpace(strings.TrimPrefix(v.name, ":not"))
+			return fmt.Sprintf("node matched `%s`", inner[1:len(inner)-1])
+		case strings.HasPrefix(v.name, ":is"), strings.HasPrefix(v.name, ":where"):
+			inner := v.name[strings.Index(v.name, "("):]
+			return fmt.Sprintf("node matched none of `%s`", inner[1:len(inner)-1])
+		case strings.HasPrefix(v.name, ":key"):
+			if node.parent == nil || node.parent.typ != J_OBJECT {
+				return fmt.Sprintf("node has no key to compare with `%s`", v.name)
+			}
+			return fmt.Sprintf("key `%s` does not match `%s`", node.parentKey(), v.name)
+		case (strings.HasPrefix(v.name, ":contains") || strings.HasPrefix(v.name, ":matches")) && node.typ != J_STRING:
+			return fmt.Sprintf("`%s` only matches strings, not `%s`", v.name, node.typ)
+		}
+		return fmt.Sprintf("`%s` rejected value %s", v.name, value)
+	}
+	return fmt.Sprintf("`%s` rejected the node", v.name)
+}